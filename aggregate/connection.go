@@ -1,46 +1,79 @@
 package aggregate
 
 import (
+	"context"
+	"errors"
 	"time"
 
 	"github.com/goforbroke1006/unknown-livecoding-1/domain"
 )
 
-func NewConnection(ip int32) *fakeConnection {
+func NewConnection(peer domain.PeerID) *fakeConnection {
 	return &fakeConnection{
-		ip: ip,
+		peer:  peer,
+		state: domain.NewStateMachine(domain.StateIdle),
 	}
 }
 
-func NewFakeConnectionOpened(ip int32) *fakeConnection {
+func NewFakeConnectionOpened(peer domain.PeerID) *fakeConnection {
 	return &fakeConnection{
-		ip:     ip,
-		opened: true,
+		peer:  peer,
+		state: domain.NewStateMachine(domain.StateOpen),
 	}
 }
 
 type fakeConnection struct {
-	ip     int32
-	opened bool
+	peer  domain.PeerID
+	state *domain.StateMachine
 }
 
 var _ domain.Connection = &fakeConnection{}
+var _ domain.StateNotifier = &fakeConnection{}
 
-func (c *fakeConnection) Open() {
-	//fmt.Println("opening connection", c.ip)
+func (c *fakeConnection) Open(ctx context.Context) error {
+	//fmt.Println("opening connection", c.peer)
+
+	if c.state.State() == domain.StateOpen {
+		return nil
+	}
+	from, ok := c.state.TransitionFrom(domain.StateConnecting, domain.StateIdle, domain.StateClosed, domain.StateFailed)
+	if !ok { // another caller is opening or closing it
+		return errors.New("fake connection can't be opened in state " + from.String())
+	}
 
 	const fakeConnectionEstablishingDuration = 5 * time.Second
-	time.Sleep(fakeConnectionEstablishingDuration)
-	c.opened = true
+	select {
+	case <-time.After(fakeConnectionEstablishingDuration):
+	case <-ctx.Done():
+		c.state.Transition(domain.StateConnecting, domain.StateFailed)
+		return ctx.Err()
+	}
+	if !c.state.Transition(domain.StateConnecting, domain.StateOpen) {
+		return errors.New("fake connection was closed while opening")
+	}
+	return nil
 }
 
-func (c *fakeConnection) Close() {
+func (c *fakeConnection) Close() error {
 	const fakeConnectionClosingDuration = 1 * time.Second
 
+	if _, ok := c.state.TransitionFrom(domain.StateClosing,
+		domain.StateIdle, domain.StateConnecting, domain.StateOpen, domain.StateFailed); !ok {
+		return nil // is closed or closing already
+	}
 	time.Sleep(fakeConnectionClosingDuration)
-	c.opened = false
+	c.state.Transition(domain.StateClosing, domain.StateClosed)
+	return nil
+}
+
+func (c *fakeConnection) State() domain.State {
+	return c.state.State()
+}
+
+func (c *fakeConnection) IsOpen() bool {
+	return c.State() == domain.StateOpen
 }
 
-func (c fakeConnection) IsOpen() bool {
-	return c.opened
+func (c *fakeConnection) OnTransition(fn func(from, to domain.State)) (unsubscribe func()) {
+	return c.state.OnTransition(fn)
 }
@@ -0,0 +1,18 @@
+package aggregate
+
+import (
+	"context"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// NewFakeDialer create dialer which opens fake connections
+func NewFakeDialer() domain.ConnectionDialer {
+	return domain.ConnectionDialerFunc(func(ctx context.Context, peer domain.PeerID) (domain.Connection, error) {
+		conn := NewConnection(peer)
+		if err := conn.Open(ctx); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+}
@@ -0,0 +1,246 @@
+package aggregate
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+const (
+	defaultTCPDialTimeout = 5 * time.Second
+	defaultTCPKeepAlive   = 15 * time.Second
+)
+
+// ErrConnectionNotOpen is returned from Read/Write before Open or after Close
+var ErrConnectionNotOpen = errors.New("tcp connection is not open")
+
+// TCPOption configures TCPConnection
+type TCPOption func(c *TCPConnection)
+
+// WithDialTimeout limits time of TCPConnection.Open, zero means no limit except ctx
+func WithDialTimeout(timeout time.Duration) TCPOption {
+	return func(c *TCPConnection) {
+		c.dialTimeout = timeout
+	}
+}
+
+// WithKeepAlive set period of TCP keep-alive probes, negative value disables them
+func WithKeepAlive(period time.Duration) TCPOption {
+	return func(c *TCPConnection) {
+		c.keepAlive = period
+	}
+}
+
+// NewTCPConnection create not opened connection to address in host:port form
+func NewTCPConnection(address string, opts ...TCPOption) *TCPConnection {
+	c := &TCPConnection{
+		address:     address,
+		dialTimeout: defaultTCPDialTimeout,
+		keepAlive:   defaultTCPKeepAlive,
+		state:       domain.NewStateMachine(domain.StateIdle),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// NewAcceptedTCPConnection wrap socket accepted by listener, connection is open already
+func NewAcceptedTCPConnection(conn net.Conn, opts ...TCPOption) *TCPConnection {
+	c := NewTCPConnection(conn.RemoteAddr().String(), opts...)
+	c.setKeepAlive(conn)
+	c.conn = conn
+	c.state.Transition(domain.StateIdle, domain.StateOpen)
+	return c
+}
+
+// TCPConnection is domain.Connection over real socket.
+// Any read or write error except timeout moves connection to domain.StateFailed
+type TCPConnection struct {
+	address     string
+	dialTimeout time.Duration
+	keepAlive   time.Duration
+
+	conn   net.Conn
+	dial   *tcpDial // dial of Open in flight
+	state  *domain.StateMachine
+	connMx sync.RWMutex
+}
+
+// tcpDial lets Close abort dial of Open
+type tcpDial struct {
+	cancel context.CancelFunc
+}
+
+var _ domain.Connection = &TCPConnection{}
+var _ domain.StateNotifier = &TCPConnection{}
+
+// Open dials address, socket lock is not held while dialing, so Close aborts the dial
+func (c *TCPConnection) Open(ctx context.Context) error {
+	c.connMx.Lock()
+	if c.state.State() == domain.StateOpen {
+		c.connMx.Unlock()
+		return nil
+	}
+	from, ok := c.state.TransitionFrom(domain.StateConnecting, domain.StateIdle, domain.StateClosed, domain.StateFailed)
+	if !ok {
+		c.connMx.Unlock()
+		return errors.New("tcp connection can't be opened in state " + from.String())
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	dial := &tcpDial{cancel: cancel}
+	c.dial = dial
+	c.connMx.Unlock()
+
+	dialer := net.Dialer{
+		Timeout:   c.dialTimeout,
+		KeepAlive: c.keepAlive,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", c.address)
+
+	c.connMx.Lock()
+	defer c.connMx.Unlock()
+
+	if c.dial != dial { // closed meanwhile, maybe it is being opened again already
+		if conn != nil {
+			_ = conn.Close()
+		}
+		if err == nil {
+			err = errors.New("tcp connection was closed while opening")
+		}
+		return err
+	}
+	c.dial = nil
+	if err != nil {
+		c.state.Transition(domain.StateConnecting, domain.StateFailed)
+		return err
+	}
+
+	if c.conn != nil {
+		_ = c.conn.Close()
+	}
+	c.conn = conn
+	c.state.Transition(domain.StateConnecting, domain.StateOpen)
+	return nil
+}
+
+func (c *TCPConnection) Close() error {
+	c.connMx.Lock()
+	defer c.connMx.Unlock()
+
+	if _, ok := c.state.TransitionFrom(domain.StateClosing,
+		domain.StateIdle, domain.StateConnecting, domain.StateOpen, domain.StateFailed); !ok {
+		return nil // is closed already
+	}
+	if c.dial != nil { // Open is dialing
+		c.dial.cancel()
+		c.dial = nil
+	}
+	var err error
+	if c.conn != nil {
+		err = c.conn.Close()
+		c.conn = nil
+	}
+	c.state.Transition(domain.StateClosing, domain.StateClosed)
+	return err
+}
+
+func (c *TCPConnection) State() domain.State {
+	return c.state.State()
+}
+
+func (c *TCPConnection) IsOpen() bool {
+	return c.State() == domain.StateOpen
+}
+
+// OnTransition subscribes fn to state transitions, fn must not call Open or Close
+func (c *TCPConnection) OnTransition(fn func(from, to domain.State)) (unsubscribe func()) {
+	return c.state.OnTransition(fn)
+}
+
+// Read from socket, see net.Conn
+func (c *TCPConnection) Read(p []byte) (int, error) {
+	conn, err := c.socket()
+	if err != nil {
+		return 0, err
+	}
+	n, err := conn.Read(p)
+	c.check(conn, err)
+	return n, err
+}
+
+// Write to socket, see net.Conn
+func (c *TCPConnection) Write(p []byte) (int, error) {
+	conn, err := c.socket()
+	if err != nil {
+		return 0, err
+	}
+	n, err := conn.Write(p)
+	c.check(conn, err)
+	return n, err
+}
+
+// SetDeadline for next Read and Write calls, see net.Conn
+func (c *TCPConnection) SetDeadline(t time.Time) error {
+	conn, err := c.socket()
+	if err != nil {
+		return err
+	}
+	return conn.SetDeadline(t)
+}
+
+// RemoteAddr returns nil if connection is not open
+func (c *TCPConnection) RemoteAddr() net.Addr {
+	conn, err := c.socket()
+	if err != nil {
+		return nil
+	}
+	return conn.RemoteAddr()
+}
+
+func (c *TCPConnection) socket() (net.Conn, error) {
+	c.connMx.RLock()
+	defer c.connMx.RUnlock()
+
+	if c.conn == nil || c.state.State() != domain.StateOpen {
+		return nil, ErrConnectionNotOpen
+	}
+	return c.conn, nil
+}
+
+// check marks connection broken if error is not a timeout, deadline exceeding keeps socket usable
+func (c *TCPConnection) check(conn net.Conn, err error) {
+	if err == nil {
+		return
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return
+	}
+
+	c.connMx.Lock()
+	if c.conn == conn { // socket was not reopened meanwhile
+		c.state.Transition(domain.StateOpen, domain.StateFailed)
+	}
+	c.connMx.Unlock()
+}
+
+func (c *TCPConnection) setKeepAlive(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if c.keepAlive < 0 {
+		_ = tcpConn.SetKeepAlive(false)
+		return
+	}
+	_ = tcpConn.SetKeepAlive(true)
+	if c.keepAlive > 0 {
+		_ = tcpConn.SetKeepAlivePeriod(c.keepAlive)
+	}
+}
@@ -0,0 +1,28 @@
+package aggregate
+
+import (
+	"context"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// NewTCPDialer create dialer which opens TCPConnection to address resolved for peer
+func NewTCPDialer(address func(peer domain.PeerID) string, opts ...TCPOption) domain.ConnectionDialer {
+	return domain.ConnectionDialerFunc(func(ctx context.Context, peer domain.PeerID) (domain.Connection, error) {
+		conn := NewTCPConnection(address(peer), opts...)
+		if err := conn.Open(ctx); err != nil {
+			return nil, err
+		}
+		return conn, nil
+	})
+}
+
+// PeerAddress resolve peer into host:port, defaultPort is used when peer has no port
+func PeerAddress(defaultPort uint16) func(peer domain.PeerID) string {
+	return func(peer domain.PeerID) string {
+		if peer.Port() == 0 {
+			peer = peer.WithPort(defaultPort)
+		}
+		return peer.String()
+	}
+}
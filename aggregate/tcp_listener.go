@@ -0,0 +1,89 @@
+package aggregate
+
+import (
+	"errors"
+	"net"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// ListenerOption configures TCPListener
+type ListenerOption func(l *TCPListener)
+
+// WithPeerResolver replace default peer resolving by remote IP address of accepted socket
+func WithPeerResolver(peerOf func(conn net.Conn) (domain.PeerID, error)) ListenerOption {
+	return func(l *TCPListener) {
+		l.peerOf = peerOf
+	}
+}
+
+// WithAcceptedOptions configures every accepted TCPConnection, e.g. keep-alive
+func WithAcceptedOptions(opts ...TCPOption) ListenerOption {
+	return func(l *TCPListener) {
+		l.connOpts = opts
+	}
+}
+
+// ListenTCP start listening address, call TCPListener.Serve to accept connections
+func ListenTCP(address string, storage domain.ConnectionsStorage, opts ...ListenerOption) (*TCPListener, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &TCPListener{
+		listener: listener,
+		storage:  storage,
+		peerOf:   remoteAddrPeer,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l, nil
+}
+
+// TCPListener hands accepted sockets to domain.ConnectionsStorage as remote connections
+type TCPListener struct {
+	listener net.Listener
+	storage  domain.ConnectionsStorage
+	peerOf   func(conn net.Conn) (domain.PeerID, error)
+	connOpts []TCPOption
+}
+
+// Serve accept connections until Close, sockets with unknown peer are dropped
+func (l *TCPListener) Serve() error {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		peer, err := l.peerOf(conn)
+		if err != nil {
+			_ = conn.Close()
+			continue
+		}
+		l.storage.OnNewRemoteConnection(peer, NewAcceptedTCPConnection(conn, l.connOpts...))
+	}
+}
+
+func (l *TCPListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// Close stop accepting, connections handed to storage stay open
+func (l *TCPListener) Close() error {
+	return l.listener.Close()
+}
+
+// remoteAddrPeer identifies peer by remote IP only, ephemeral port of remote side is dropped
+func remoteAddrPeer(conn net.Conn) (domain.PeerID, error) {
+	peer, err := domain.PeerFromNetAddr(conn.RemoteAddr())
+	if err != nil {
+		return domain.PeerID{}, err
+	}
+	return peer.WithPort(0), nil
+}
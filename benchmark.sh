@@ -13,6 +13,8 @@ bench_list=(
   "BenchmarkPubSubPrimitive_Subscribe"
   "BenchmarkConnectionStorageOnMutex_GetConnection"
   "BenchmarkConnectionStorageOnChan_GetConnection"
+  "BenchmarkConnectionStorageSharded_GetConnection"
+  "BenchmarkConnectionStorageCopyOnWrite_GetConnection"
   "BenchmarkConnectionStorageOnChan_Shutdown"
 )
 
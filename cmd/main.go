@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"time"
 
@@ -12,7 +13,13 @@ import (
 func main() {
 	storage := internal.NewConnectionStorageOnChan(1024)
 	go storage.Run()
-	defer storage.Shutdown()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := storage.Shutdown(ctx); err != nil {
+			fmt.Println(err)
+		}
+	}()
 
 	start := time.Now()
 
@@ -20,15 +27,24 @@ func main() {
 		for {
 			for ip := int32(200); ip >= 100; ip-- {
 				<-time.After(10 * time.Millisecond)
-				storage.OnNewRemoteConnection(ip, aggregate.NewConnection(ip))
+				peer := domain.PeerFromInt32(ip)
+				storage.OnNewRemoteConnection(peer, aggregate.NewFakeConnectionOpened(peer))
 			}
 		}
 	}()
 
-	var opened []domain.Connection
+	var peers []domain.PeerID
 	for ip := int32(100); ip <= 200; ip++ {
-		conn := storage.GetConnection(ip)
-		opened = append(opened, conn)
+		peers = append(peers, domain.PeerFromInt32(ip))
+	}
+
+	var opened []domain.Connection
+	for peer, result := range storage.GetConnections(context.Background(), peers) {
+		if result.Err != nil {
+			fmt.Printf("can't open connection to %s: %v\n", peer, result.Err)
+			continue
+		}
+		opened = append(opened, result.Conn)
 	}
 
 	fmt.Printf("all connection (count %d) are opened in %.4f seconds!!!\n", len(opened), time.Since(start).Seconds())
@@ -1,14 +1,63 @@
 package domain
 
+import "context"
+
 type Connection interface {
-	Open()
-	Close()
+	// Open establish connection, returns error if it can't be done or ctx is done before
+	Open(ctx context.Context) error
+	Close() error
+	// State returns current stage of connection lifecycle
+	State() State
+	// IsOpen is shortcut for State() == StateOpen
 	IsOpen() bool
 }
 
-type ConnectionsStorage interface {
-	GetConnection(ipAddress int32) Connection
-	OnNewRemoteConnection(remotePeer int32, conn Connection)
+// Storage keeps single connection of type C per peer K and dedupes dialing to the same peer
+type Storage[K comparable, C Connection] interface {
+	// GetConnection returns zero C if connection can't be established
+	GetConnection(peer K) C
+	// GetConnectionContext same as GetConnection but gives up when ctx is done
+	// and returns *GetConnectionError wrapping ctx.Err() or dial error
+	GetConnectionContext(ctx context.Context, peer K) (C, error)
+	// GetConnections resolves cached peers at once and gets missing ones in parallel,
+	// every peer has own result, error is *GetConnectionError like in GetConnectionContext
+	GetConnections(ctx context.Context, peers []K) map[K]ConnectionResult[C]
+	// Acquire same as GetConnectionContext but borrows connection,
+	// replaced or evicted connection is not closed until all its leases are released
+	Acquire(ctx context.Context, peer K) (Lease[C], error)
+	// OnNewRemoteConnection stores connection accepted from peer and gives it to its waiters,
+	// connection which is not open is closed instead
+	OnNewRemoteConnection(remotePeer K, conn C)
+	// Peek returns cached open connection without dialing
+	Peek(peer K) (C, bool)
+	// Range calls fn for every cached connection until fn returns false,
+	// fn works with copy of cache, so it may call storage
+	Range(fn func(peer K, conn C) bool)
+	// Len returns count of cached connections
+	Len() int
+	// Disconnect closes and removes peer's connection, returns false if there was nothing to remove
+	Disconnect(peer K) bool
 	Run()
-	Shutdown()
+	// Shutdown rejects new callers with ErrStorageClosed, cancels in-flight dials and waits
+	// for cached connections to close until ctx is done. Returns *ShutdownError listing peers
+	// which connections failed to close. Repeated calls wait for the first one
+	Shutdown(ctx context.Context) error
+	// Done is closed when storage is shut down and its connections are retired
+	Done() <-chan struct{}
+}
+
+// Lease is connection borrowed from Storage
+type Lease[C Connection] interface {
+	Conn() C
+	// Release gives connection back, it may be closed right after. Repeated calls do nothing
+	Release()
 }
+
+// ConnectionResult is connection or error got for one peer of batch
+type ConnectionResult[C Connection] struct {
+	Conn C
+	Err  error
+}
+
+// ConnectionsStorage is Storage of network connections
+type ConnectionsStorage = Storage[PeerID, Connection]
@@ -0,0 +1,14 @@
+package domain
+
+import "time"
+
+// ConnectionInfo describes connection cached by storage for peer K
+type ConnectionInfo[K comparable] struct {
+	Peer      K
+	Direction Direction
+	Created   time.Time // when connection was put into storage
+	LastUsed  time.Time // when cached connection was given to caller last time
+	// DialDuration is how long outbound connection was dialed including retries, zero for inbound one
+	DialDuration time.Duration
+	Uses         uint64 // how many times cached connection was given to callers, first dial is not counted
+}
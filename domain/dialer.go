@@ -0,0 +1,21 @@
+package domain
+
+import "context"
+
+// Dialer establish new opened connection to peer
+type Dialer[K comparable, C Connection] interface {
+	Dial(ctx context.Context, peer K) (C, error)
+}
+
+// DialerFunc allows to use ordinary function as Dialer
+type DialerFunc[K comparable, C Connection] func(ctx context.Context, peer K) (C, error)
+
+func (f DialerFunc[K, C]) Dial(ctx context.Context, peer K) (C, error) {
+	return f(ctx, peer)
+}
+
+// ConnectionDialer is Dialer of network connections
+type ConnectionDialer = Dialer[PeerID, Connection]
+
+// ConnectionDialerFunc allows to use ordinary function as ConnectionDialer
+type ConnectionDialerFunc = DialerFunc[PeerID, Connection]
@@ -0,0 +1,23 @@
+package domain
+
+// Direction tells which side has opened connection
+type Direction int
+
+const (
+	DirectionUnknown Direction = iota
+	// Outbound connection is dialed by local side
+	Outbound
+	// Inbound connection is accepted from remote peer
+	Inbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Outbound:
+		return "outbound"
+	case Inbound:
+		return "inbound"
+	default:
+		return "unknown"
+	}
+}
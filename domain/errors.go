@@ -0,0 +1,55 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrStorageFull is returned when storage reached its capacity and no connection can be evicted
+var ErrStorageFull = errors.New("connection storage is full")
+
+// ErrCircuitOpen is returned without dialing when recent dials to peer failed too many times
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// ErrStorageClosed is returned when storage is shut down or shutting down
+var ErrStorageClosed = errors.New("connection storage is closed")
+
+// GetConnectionError describes why storage could not return connection for peer
+type GetConnectionError struct {
+	Peer interface{}
+	Err  error
+}
+
+func (e *GetConnectionError) Error() string {
+	return fmt.Sprintf("get connection to %v: %v", e.Peer, e.Err)
+}
+
+func (e *GetConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// ShutdownError lists peers which connections were not closed by Shutdown
+type ShutdownError struct {
+	// Failed is close error of every peer, connections not closed before deadline have ctx error
+	Failed map[interface{}]error
+	// Err is ctx error if deadline came before all connections were closed
+	Err error
+}
+
+func (e *ShutdownError) Error() string {
+	if len(e.Failed) == 0 {
+		return fmt.Sprintf("shutdown: %v", e.Err)
+	}
+	failures := make([]string, 0, len(e.Failed))
+	for peer, err := range e.Failed {
+		failures = append(failures, fmt.Sprintf("%v: %v", peer, err))
+	}
+	sort.Strings(failures)
+	return fmt.Sprintf("shutdown: %d connections failed to close: %s", len(e.Failed), strings.Join(failures, "; "))
+}
+
+func (e *ShutdownError) Unwrap() error {
+	return e.Err
+}
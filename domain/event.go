@@ -0,0 +1,46 @@
+package domain
+
+import "time"
+
+// EventKind is kind of connection lifecycle event
+type EventKind int
+
+const (
+	// EventDialing is emitted when storage starts dialing peer
+	EventDialing EventKind = iota + 1
+	// EventOpened is emitted when connection is put into storage for peer without connection
+	EventOpened
+	// EventReplaced is emitted when peer's cached connection is replaced by new one and closed
+	EventReplaced
+	// EventClosed is emitted when peer's connection is closed and removed from storage,
+	// e.g. it is dead, expired, evicted, disconnected or storage is shut down
+	EventClosed
+	// EventDialFailed is emitted when dial to peer failed, Event.Err tells why
+	EventDialFailed
+)
+
+func (k EventKind) String() string {
+	switch k {
+	case EventDialing:
+		return "dialing"
+	case EventOpened:
+		return "opened"
+	case EventReplaced:
+		return "replaced"
+	case EventClosed:
+		return "closed"
+	case EventDialFailed:
+		return "dial failed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is connection lifecycle event of peer K
+type Event[K comparable] struct {
+	Kind      EventKind
+	Peer      K
+	Direction Direction // of opened, replacing or closed connection
+	Err       error     // why dial failed
+	At        time.Time
+}
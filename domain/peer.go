@@ -0,0 +1,182 @@
+package domain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// PeerID identifies remote peer by IPv4/IPv6 address or host name with optional port.
+// It is comparable, so it can be used as map key, zero port means port is not specified
+type PeerID struct {
+	addr netip.Addr // valid if peer is IP address
+	host string     // used if peer is host name
+	port uint16
+}
+
+// PeerFromAddr create peer without port
+func PeerFromAddr(addr netip.Addr) PeerID {
+	return PeerID{addr: addr.Unmap()}
+}
+
+// PeerFromAddrPort create peer with port
+func PeerFromAddrPort(addrPort netip.AddrPort) PeerID {
+	return PeerID{addr: addrPort.Addr().Unmap(), port: addrPort.Port()}
+}
+
+// PeerFromHost create peer from IP literal or host name
+func PeerFromHost(host string, port uint16) PeerID {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return PeerID{addr: addr.Unmap(), port: port}
+	}
+	return PeerID{host: host, port: port}
+}
+
+// PeerFromInt32 convert legacy int32 peer into IPv4 address without port
+func PeerFromInt32(ip int32) PeerID {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(ip))
+	return PeerID{addr: netip.AddrFrom4(b)}
+}
+
+// PeerFromNetAddr create peer from address of socket, port is kept
+func PeerFromNetAddr(addr net.Addr) (PeerID, error) {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return PeerFromAddrPort(a.AddrPort()), nil
+	case *net.UDPAddr:
+		return PeerFromAddrPort(a.AddrPort()), nil
+	}
+	return ParsePeerID(addr.String())
+}
+
+// ParsePeerID parse "1.2.3.4", "1.2.3.4:80", "::1", "[::1]:80", "example.com" or "example.com:80"
+func ParsePeerID(s string) (PeerID, error) {
+	if s == "" {
+		return PeerID{}, errors.New("empty peer")
+	}
+	if addr, err := netip.ParseAddr(s); err == nil {
+		return PeerFromAddr(addr), nil
+	}
+
+	host, port := s, uint64(0)
+	if strings.ContainsAny(s, ":[]") { // not IP address, so it should be host with port
+		var (
+			portStr string
+			err     error
+		)
+		if host, portStr, err = net.SplitHostPort(s); err != nil {
+			return PeerID{}, fmt.Errorf("invalid peer %q: %w", s, err)
+		}
+		if port, err = strconv.ParseUint(portStr, 10, 16); err != nil {
+			return PeerID{}, fmt.Errorf("invalid port in peer %q: %w", s, err)
+		}
+	}
+	if host == "" {
+		return PeerID{}, fmt.Errorf("empty host in peer %q", s)
+	}
+	if _, err := netip.ParseAddr(host); err != nil && !validHostName(host) {
+		return PeerID{}, fmt.Errorf("invalid host name in peer %q", s)
+	}
+	return PeerFromHost(host, uint16(port)), nil
+}
+
+// validHostName reports host is dot separated labels of letters, digits, '-' and '_',
+// label is 1-63 chars and does not start or end with '-'
+func validHostName(host string) bool {
+	host = strings.TrimSuffix(host, ".") // fully qualified name
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, r := range label {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Addr returns false if peer is host name
+func (p PeerID) Addr() (netip.Addr, bool) {
+	return p.addr, p.addr.IsValid()
+}
+
+// Port returns zero if port is not specified
+func (p PeerID) Port() uint16 {
+	return p.port
+}
+
+// Host returns IP address or host name without port
+func (p PeerID) Host() string {
+	if p.addr.IsValid() {
+		return p.addr.String()
+	}
+	return p.host
+}
+
+// WithPort returns same peer with another port
+func (p PeerID) WithPort(port uint16) PeerID {
+	p.port = port
+	return p
+}
+
+// Int32 convert peer back into legacy form, it is possible for IPv4 without port only
+func (p PeerID) Int32() (int32, bool) {
+	if !p.addr.Is4() || p.port != 0 {
+		return 0, false
+	}
+	b := p.addr.As4()
+	return int32(binary.BigEndian.Uint32(b[:])), true
+}
+
+// Compare returns -1, 0 or 1 if p is less, equal or greater than other.
+// Peers are ordered by address, host name and port, so both ends of link order them the same way
+func (p PeerID) Compare(other PeerID) int {
+	if c := p.addr.Compare(other.addr); c != 0 {
+		return c
+	}
+	if c := strings.Compare(p.host, other.host); c != 0 {
+		return c
+	}
+	switch {
+	case p.port < other.port:
+		return -1
+	case p.port > other.port:
+		return 1
+	}
+	return 0
+}
+
+// Hash returns FNV-1a hash of peer, equal peers have equal hashes
+func (p PeerID) Hash() uint64 {
+	h := fnv.New64a()
+	addr := p.addr.As16()
+	_, _ = h.Write(addr[:])
+	_, _ = h.Write([]byte(p.host))
+	_, _ = h.Write([]byte{byte(p.port >> 8), byte(p.port)})
+	return h.Sum64()
+}
+
+func (p PeerID) IsZero() bool {
+	return p == PeerID{}
+}
+
+// String returns host or host:port, IPv6 with port is wrapped in brackets
+func (p PeerID) String() string {
+	if p.port == 0 {
+		return p.Host()
+	}
+	return net.JoinHostPort(p.Host(), strconv.Itoa(int(p.port)))
+}
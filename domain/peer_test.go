@@ -0,0 +1,103 @@
+package domain
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParsePeerID(t *testing.T) {
+	tests := []struct {
+		input string
+		host  string
+		port  uint16
+		isIP  bool
+	}{
+		{input: "10.0.0.1", host: "10.0.0.1", isIP: true},
+		{input: "10.0.0.1:8080", host: "10.0.0.1", port: 8080, isIP: true},
+		{input: "::1", host: "::1", isIP: true},
+		{input: "[2001:db8::1]:443", host: "2001:db8::1", port: 443, isIP: true},
+		{input: "example.com", host: "example.com"},
+		{input: "example.com:80", host: "example.com", port: 80},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			peer, err := ParsePeerID(tt.input)
+			assert.Nil(t, err)
+			assert.Equal(t, tt.host, peer.Host())
+			assert.Equal(t, tt.port, peer.Port())
+			_, isIP := peer.Addr()
+			assert.Equal(t, tt.isIP, isIP)
+			assert.Equal(t, tt.input, peer.String())
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, input := range []string{
+			"", "1.2.3.4:http", ":80",
+			"1.2.3.4:80:90", "[::1", "::1]:80", "exa mple.com", "exa mple.com:80", "-example.com", "example..com",
+		} {
+			_, err := ParsePeerID(input)
+			assert.NotNil(t, err, input)
+		}
+	})
+}
+
+func TestPeerFromInt32(t *testing.T) {
+	t.Run("round trip", func(t *testing.T) {
+		for _, ip := range []int32{0, 123, -1, 2130706433} {
+			peer := PeerFromInt32(ip)
+			back, ok := peer.Int32()
+			assert.True(t, ok)
+			assert.Equal(t, ip, back)
+		}
+	})
+
+	t.Run("IPv4 form", func(t *testing.T) {
+		assert.Equal(t, "0.0.0.123", PeerFromInt32(123).String())
+		assert.Equal(t, PeerFromAddr(netip.MustParseAddr("127.0.0.1")), PeerFromInt32(2130706433))
+	})
+
+	t.Run("no legacy form for port and IPv6", func(t *testing.T) {
+		_, ok := PeerFromInt32(123).WithPort(80).Int32()
+		assert.False(t, ok)
+		_, ok = PeerFromAddr(netip.MustParseAddr("::1")).Int32()
+		assert.False(t, ok)
+	})
+}
+
+func TestPeerFromNetAddr(t *testing.T) {
+	peer, err := PeerFromNetAddr(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000})
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:5000", peer.String())
+	assert.Equal(t, PeerFromInt32(2130706433).WithPort(5000), peer)
+}
+
+func TestPeerID_Compare(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b PeerID
+		want int
+	}{
+		{name: "equal", a: PeerFromInt32(1), b: PeerFromInt32(1), want: 0},
+		{name: "by address", a: PeerFromInt32(1), b: PeerFromInt32(2), want: -1},
+		{name: "by port", a: PeerFromInt32(1).WithPort(90), b: PeerFromInt32(1).WithPort(80), want: 1},
+		{name: "by host", a: PeerFromHost("a.local", 0), b: PeerFromHost("b.local", 0), want: -1},
+		{name: "IPv4 before IPv6", a: PeerFromInt32(1), b: PeerFromAddr(netip.MustParseAddr("::1")), want: -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.a.Compare(tt.b))
+			assert.Equal(t, -tt.want, tt.b.Compare(tt.a))
+		})
+	}
+}
+
+func TestPeerID_Hash(t *testing.T) {
+	assert.Equal(t, PeerFromInt32(1).Hash(), PeerFromHost("0.0.0.1", 0).Hash())
+	assert.NotEqual(t, PeerFromInt32(1).Hash(), PeerFromInt32(2).Hash())
+	assert.NotEqual(t, PeerFromInt32(1).Hash(), PeerFromInt32(1).WithPort(80).Hash())
+	assert.NotEqual(t, PeerFromHost("a.local", 0).Hash(), PeerFromHost("b.local", 0).Hash())
+}
@@ -0,0 +1,147 @@
+package domain
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// State is stage of connection lifecycle
+type State int32
+
+const (
+	// StateIdle connection is created but not opened yet
+	StateIdle State = iota
+	StateConnecting
+	StateOpen
+	StateClosing
+	StateClosed
+	// StateFailed connection could not be opened or broke while it was open
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateIdle:
+		return "idle"
+	case StateConnecting:
+		return "connecting"
+	case StateOpen:
+		return "open"
+	case StateClosing:
+		return "closing"
+	case StateClosed:
+		return "closed"
+	case StateFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// validTransitions lists states reachable from each state
+var validTransitions = map[State][]State{
+	StateIdle:       {StateConnecting, StateOpen, StateClosing, StateClosed},
+	StateConnecting: {StateOpen, StateFailed, StateClosing, StateClosed},
+	StateOpen:       {StateClosing, StateFailed},
+	StateClosing:    {StateClosed},
+	StateClosed:     {StateConnecting},
+	StateFailed:     {StateConnecting, StateClosing, StateClosed},
+}
+
+// CanTransition reports connection may go from one state to another
+func CanTransition(from, to State) bool {
+	for _, s := range validTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StateNotifier is implemented by connections which report their state transitions
+type StateNotifier interface {
+	// OnTransition calls fn after every transition until returned unsubscribe is called.
+	// fn is called synchronously by goroutine changing state, so it must not block
+	OnTransition(fn func(from, to State)) (unsubscribe func())
+}
+
+// StateMachine keeps connection state with atomic transitions, zero value is StateIdle
+type StateMachine struct {
+	state int32
+
+	subs   map[int]func(from, to State)
+	nextID int
+	subsMx sync.RWMutex
+}
+
+var _ StateNotifier = &StateMachine{}
+
+// NewStateMachine create machine in initial state
+func NewStateMachine(initial State) *StateMachine {
+	return &StateMachine{state: int32(initial)}
+}
+
+func (m *StateMachine) State() State {
+	return State(atomic.LoadInt32(&m.state))
+}
+
+// Transition moves machine from one state to another if it is valid and machine is in from state now
+func (m *StateMachine) Transition(from, to State) bool {
+	if !CanTransition(from, to) || !atomic.CompareAndSwapInt32(&m.state, int32(from), int32(to)) {
+		return false
+	}
+	m.notify(from, to)
+	return true
+}
+
+// TransitionFrom moves machine to state from any of listed states, returns state machine was in
+// and false if it was in none of them
+func (m *StateMachine) TransitionFrom(to State, from ...State) (State, bool) {
+	for {
+		current := m.State()
+		allowed := false
+		for _, s := range from {
+			allowed = allowed || s == current
+		}
+		if !allowed {
+			return current, false
+		}
+		if m.Transition(current, to) {
+			return current, true
+		}
+		if !CanTransition(current, to) {
+			return current, false
+		}
+	}
+}
+
+func (m *StateMachine) OnTransition(fn func(from, to State)) (unsubscribe func()) {
+	m.subsMx.Lock()
+	defer m.subsMx.Unlock()
+
+	if m.subs == nil {
+		m.subs = make(map[int]func(from, to State))
+	}
+	id := m.nextID
+	m.nextID++
+	m.subs[id] = fn
+
+	return func() {
+		m.subsMx.Lock()
+		delete(m.subs, id)
+		m.subsMx.Unlock()
+	}
+}
+
+func (m *StateMachine) notify(from, to State) {
+	m.subsMx.RLock()
+	subs := make([]func(from, to State), 0, len(m.subs))
+	for _, fn := range m.subs {
+		subs = append(subs, fn)
+	}
+	m.subsMx.RUnlock()
+
+	for _, fn := range subs {
+		fn(from, to)
+	}
+}
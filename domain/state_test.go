@@ -0,0 +1,70 @@
+package domain
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStateMachine(t *testing.T) {
+	t.Run("valid transitions only", func(t *testing.T) {
+		m := NewStateMachine(StateIdle)
+
+		assert.False(t, m.Transition(StateIdle, State(42)))
+		assert.False(t, m.Transition(StateOpen, StateClosing), "machine is not open")
+		assert.True(t, m.Transition(StateIdle, StateConnecting))
+		assert.True(t, m.Transition(StateConnecting, StateOpen))
+		assert.False(t, m.Transition(StateOpen, StateIdle))
+		assert.Equal(t, StateOpen, m.State())
+
+		from, ok := m.TransitionFrom(StateClosing, StateOpen, StateFailed)
+		assert.True(t, ok)
+		assert.Equal(t, StateOpen, from)
+
+		from, ok = m.TransitionFrom(StateClosing, StateOpen, StateFailed)
+		assert.False(t, ok)
+		assert.Equal(t, StateClosing, from)
+	})
+
+	t.Run("only one of concurrent transitions wins", func(t *testing.T) {
+		m := NewStateMachine(StateOpen)
+
+		var (
+			wins int32
+			wg   sync.WaitGroup
+		)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if m.Transition(StateOpen, StateClosing) {
+					atomic.AddInt32(&wins, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		assert.Equal(t, int32(1), wins)
+	})
+
+	t.Run("subscribers are notified until unsubscribed", func(t *testing.T) {
+		var m StateMachine // zero value is idle
+
+		var transitions [][2]State
+		unsubscribe := m.OnTransition(func(from, to State) {
+			transitions = append(transitions, [2]State{from, to})
+		})
+
+		m.Transition(StateIdle, StateConnecting)
+		m.Transition(StateConnecting, StateFailed)
+		unsubscribe()
+		m.Transition(StateFailed, StateClosed)
+
+		assert.Equal(t, [][2]State{
+			{StateIdle, StateConnecting},
+			{StateConnecting, StateFailed},
+		}, transitions)
+		assert.Equal(t, StateClosed, m.State())
+	})
+}
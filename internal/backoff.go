@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	defaultBackoffInitial  = 100 * time.Millisecond
+	defaultBackoffMax      = 10 * time.Second
+	defaultBackoffJitter   = 0.2
+	defaultBackoffAttempts = 1 // dial once, retries are enabled by WithReconnect
+)
+
+// backoff computes exponentially growing delays between attempts
+type backoff struct {
+	initial    time.Duration
+	max        time.Duration
+	jitter     float64 // part of delay which is randomly cut off, from 0 to 1
+	attempts   int
+	maxElapsed time.Duration // zero means no limit
+}
+
+func defaultBackoff() backoff {
+	return backoff{
+		initial:  defaultBackoffInitial,
+		max:      defaultBackoffMax,
+		jitter:   defaultBackoffJitter,
+		attempts: defaultBackoffAttempts,
+	}
+}
+
+// delay before attempt, first attempt (zero) is not delayed
+func (b backoff) delay(attempt int) time.Duration {
+	if attempt <= 0 {
+		return 0
+	}
+	d := b.initial
+	for i := 1; i < attempt && d < b.max; i++ {
+		d *= 2
+	}
+	if d > b.max {
+		d = b.max
+	}
+	if cut := int64(float64(d) * b.jitter); cut > 0 {
+		d -= time.Duration(rand.Int63n(cut + 1))
+	}
+	return d
+}
+
+// exhausted reports no more attempts should be done after attempt failed
+func (b backoff) exhausted(attempt int, elapsed time.Duration) bool {
+	if attempt+1 >= b.attempts {
+		return true
+	}
+	return b.maxElapsed > 0 && elapsed >= b.maxElapsed
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"context"
+	"sync"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// getBatch returns result for every peer. Hits are found by lookup at once,
+// misses are got by get concurrently, so their dials run in parallel under dial limiter
+func getBatch[K comparable, C domain.Connection](
+	ctx context.Context,
+	peers []K,
+	probe HealthProbe,
+	lookup func(peers []K) map[K]C,
+	get func(ctx context.Context, peer K) (C, error),
+) map[K]domain.ConnectionResult[C] {
+	results := make(map[K]domain.ConnectionResult[C], len(peers))
+	hits := lookup(peers)
+
+	var misses []K
+	for _, peer := range peers {
+		if _, seen := results[peer]; seen {
+			continue
+		}
+		if conn, hit := hits[peer]; hit && probe.check(ctx, conn) == nil {
+			results[peer] = domain.ConnectionResult[C]{Conn: conn}
+			continue
+		}
+		results[peer] = domain.ConnectionResult[C]{} // is filled by get
+		misses = append(misses, peer)
+	}
+
+	var (
+		wg        sync.WaitGroup
+		resultsMx sync.Mutex
+	)
+	for _, peer := range misses {
+		wg.Add(1)
+		go func(peer K) {
+			defer wg.Done()
+
+			conn, err := get(ctx, peer)
+			resultsMx.Lock()
+			results[peer] = domain.ConnectionResult[C]{Conn: conn, Err: err}
+			resultsMx.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	return results
+}
@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// BreakerState is state of peer's circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets dials go
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails dials fast with domain.ErrCircuitOpen
+	BreakerOpen
+	// BreakerHalfOpen lets one trial dial go, its result closes or opens breaker again
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breakerPolicy opens breaker after threshold dial failures in a row and keeps it open for openTimeout
+type breakerPolicy struct {
+	threshold   int
+	openTimeout time.Duration
+}
+
+func (p breakerPolicy) enabled() bool {
+	return p.threshold > 0
+}
+
+// forgetAfter is how long peer is remembered without new failures or trials, not less than dialFailureTTL
+func (p breakerPolicy) forgetAfter() time.Duration {
+	if 2*p.openTimeout < dialFailureTTL {
+		return dialFailureTTL
+	}
+	return 2 * p.openTimeout
+}
+
+// circuitBreaker tracks dial failures of every peer
+type circuitBreaker[K comparable] struct {
+	policy breakerPolicy
+
+	peersMx sync.Mutex
+	peers   map[K]*breakerPeer // closed peers without failures are not kept
+	sweptAt time.Time
+}
+
+type breakerPeer struct {
+	state    BreakerState
+	failures int
+	failedAt time.Time
+	openedAt time.Time
+	trial    bool // half-open trial dial is in flight
+}
+
+// stale reports peer can be forgotten: it did not fail for a while or its breaker is open
+// for long after timeout and nobody tried it. Forgotten peer is closed for next dial
+func (p *breakerPeer) stale(policy breakerPolicy, now time.Time) bool {
+	if p.trial {
+		return false
+	}
+	if p.state == BreakerClosed {
+		return now.Sub(p.failedAt) >= policy.forgetAfter()
+	}
+	return now.Sub(p.openedAt) >= policy.forgetAfter()
+}
+
+func newCircuitBreaker[K comparable](policy breakerPolicy) *circuitBreaker[K] {
+	return &circuitBreaker[K]{
+		policy: policy,
+		peers:  make(map[K]*breakerPeer),
+	}
+}
+
+// allow returns domain.ErrCircuitOpen if peer should not be dialed now.
+// Nil result obliges caller to report dial outcome with done
+func (b *circuitBreaker[K]) allow(peer K, now time.Time) error {
+	if !b.policy.enabled() {
+		return nil
+	}
+
+	b.peersMx.Lock()
+	defer b.peersMx.Unlock()
+
+	p, found := b.peers[peer]
+	if !found {
+		return nil
+	}
+	if p.state == BreakerOpen && now.Sub(p.openedAt) >= b.policy.openTimeout {
+		p.state = BreakerHalfOpen
+	}
+	switch {
+	case p.state == BreakerOpen:
+		return domain.ErrCircuitOpen
+	case p.state == BreakerHalfOpen && p.trial:
+		return domain.ErrCircuitOpen
+	case p.state == BreakerHalfOpen:
+		p.trial = true
+	}
+	return nil
+}
+
+// done records outcome of dial allowed by allow, aborted dial is not peer's fault and is not counted
+func (b *circuitBreaker[K]) done(peer K, err error, aborted bool, now time.Time) {
+	if !b.policy.enabled() {
+		return
+	}
+
+	b.peersMx.Lock()
+	defer b.peersMx.Unlock()
+
+	p, found := b.peers[peer]
+	switch {
+	case err == nil:
+		delete(b.peers, peer)
+	case aborted:
+		if found {
+			p.trial = false
+		}
+	default:
+		b.sweep(now)
+		if !found {
+			p = &breakerPeer{}
+			b.peers[peer] = p
+		}
+		p.failures++
+		p.failedAt = now
+		p.trial = false
+		if p.state == BreakerHalfOpen || p.failures >= b.policy.threshold {
+			p.state, p.openedAt = BreakerOpen, now
+		}
+	}
+}
+
+// sweep forgets stale peers once per forgetAfter, so peers which are never dialed again don't stay forever.
+// Should be called under peersMx lock
+func (b *circuitBreaker[K]) sweep(now time.Time) {
+	if now.Sub(b.sweptAt) < b.policy.forgetAfter() {
+		return
+	}
+	for peer, p := range b.peers {
+		if p.stale(b.policy, now) {
+			delete(b.peers, peer)
+		}
+	}
+	b.sweptAt = now
+}
+
+// state returns current state of peer's breaker, open breaker is half-open once timeout passed
+func (b *circuitBreaker[K]) state(peer K, now time.Time) BreakerState {
+	b.peersMx.Lock()
+	defer b.peersMx.Unlock()
+
+	p, found := b.peers[peer]
+	if !found {
+		return BreakerClosed
+	}
+	if p.state == BreakerOpen && now.Sub(p.openedAt) >= b.policy.openTimeout {
+		return BreakerHalfOpen
+	}
+	return p.state
+}
+
+// breakerDialer wraps dialer, so dials are counted by breaker and rejected while it is open
+func breakerDialer[K comparable, C domain.Connection](b *circuitBreaker[K], dialer domain.Dialer[K, C]) domain.Dialer[K, C] {
+	if !b.policy.enabled() {
+		return dialer
+	}
+	return domain.DialerFunc[K, C](func(ctx context.Context, peer K) (C, error) {
+		if err := b.allow(peer, time.Now()); err != nil {
+			var zero C
+			return zero, err
+		}
+		conn, err := dialer.Dial(ctx, peer)
+		b.done(peer, err, ctx.Err() != nil, time.Now())
+		return conn, err
+	})
+}
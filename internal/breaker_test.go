@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	errDial := errors.New("connection refused")
+	now := time.Now()
+	b := newCircuitBreaker[string](breakerPolicy{threshold: 2, openTimeout: time.Minute})
+
+	assert.Nil(t, b.allow("peer", now))
+	b.done("peer", errDial, false, now)
+	assert.Equal(t, BreakerClosed, b.state("peer", now))
+
+	b.done("peer", errDial, true, now) // aborted dial is not counted
+	assert.Equal(t, BreakerClosed, b.state("peer", now))
+
+	b.done("peer", errDial, false, now)
+	assert.Equal(t, BreakerOpen, b.state("peer", now))
+	assert.True(t, errors.Is(b.allow("peer", now), domain.ErrCircuitOpen))
+	assert.Nil(t, b.allow("other", now))
+
+	later := now.Add(time.Minute)
+	assert.Equal(t, BreakerHalfOpen, b.state("peer", later))
+	assert.Nil(t, b.allow("peer", later))
+	assert.True(t, errors.Is(b.allow("peer", later), domain.ErrCircuitOpen), "only one trial dial")
+
+	b.done("peer", errDial, false, later)
+	assert.Equal(t, BreakerOpen, b.state("peer", later), "failed trial opens breaker again")
+
+	evenLater := later.Add(time.Minute)
+	assert.Nil(t, b.allow("peer", evenLater))
+	b.done("peer", nil, false, evenLater)
+	assert.Equal(t, BreakerClosed, b.state("peer", evenLater))
+	assert.Empty(t, b.peers)
+}
+
+func TestCircuitBreaker_ForgetsStalePeers(t *testing.T) {
+	errDial := errors.New("connection refused")
+	now := time.Now()
+	b := newCircuitBreaker[string](breakerPolicy{threshold: 2, openTimeout: time.Minute})
+
+	b.done("failed-once", errDial, false, now)
+	b.done("tripped", errDial, false, now)
+	b.done("tripped", errDial, false, now)
+	assert.Equal(t, BreakerOpen, b.state("tripped", now))
+
+	// failure of another peer sweeps peers which are never dialed again
+	b.done("other", errDial, false, now.Add(b.policy.forgetAfter()))
+	assert.Len(t, b.peers, 1)
+	assert.Equal(t, BreakerClosed, b.state("tripped", now.Add(b.policy.forgetAfter())))
+}
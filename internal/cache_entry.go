@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// cacheEntry is connection kept in storage with its usage times
+type cacheEntry[C domain.Connection] struct {
+	conn    C
+	origin  origin
+	created time.Time
+
+	lastUsed int64 // unix nano, entry can be touched under read lock
+	uses     uint64
+
+	leaseMx sync.Mutex
+	leases  int
+	retired bool   // is removed from cache, connection is closed when leases are released
+	closeFn func() // closes connection of retired entry
+}
+
+// origin tells how connection has got into storage
+type origin struct {
+	direction    domain.Direction
+	dialDuration time.Duration
+}
+
+// inbound is origin of connection from OnNewRemoteConnection
+var inbound = origin{direction: domain.Inbound}
+
+// dialed is origin of connection opened by local dial
+func dialed(dialDuration time.Duration) origin {
+	return origin{direction: domain.Outbound, dialDuration: dialDuration}
+}
+
+func newCacheEntry[C domain.Connection](conn C, origin origin, now time.Time) *cacheEntry[C] {
+	return &cacheEntry[C]{
+		conn:     conn,
+		origin:   origin,
+		created:  now,
+		lastUsed: now.UnixNano(),
+	}
+}
+
+func (e *cacheEntry[C]) touch(now time.Time) {
+	atomic.StoreInt64(&e.lastUsed, now.UnixNano())
+}
+
+// use marks connection is given to caller
+func (e *cacheEntry[C]) use(now time.Time) {
+	e.touch(now)
+	atomic.AddUint64(&e.uses, 1)
+}
+
+func (e *cacheEntry[C]) stats() EntryStats {
+	return EntryStats{
+		Created:  e.created,
+		LastUsed: e.lastUsedAt(),
+		Uses:     atomic.LoadUint64(&e.uses),
+	}
+}
+
+// lease borrows connection, returns false if entry is removed from cache already
+func (e *cacheEntry[C]) lease() bool {
+	e.leaseMx.Lock()
+	defer e.leaseMx.Unlock()
+
+	if e.retired {
+		return false
+	}
+	e.leases++
+	return true
+}
+
+// release gives connection back and closes it if entry is retired and it was the last lease
+func (e *cacheEntry[C]) release() {
+	e.leaseMx.Lock()
+	defer e.leaseMx.Unlock()
+
+	if e.leases--; e.retired && e.leases == 0 {
+		e.closeFn()
+	}
+}
+
+// retire marks entry is removed from cache, closeFn is called once connection is not leased.
+// Returns false if entry was retired already
+func (e *cacheEntry[C]) retire(closeFn func()) bool {
+	e.leaseMx.Lock()
+	defer e.leaseMx.Unlock()
+
+	if e.retired {
+		return false
+	}
+	e.retired, e.closeFn = true, closeFn
+	if e.leases == 0 {
+		closeFn()
+	}
+	return true
+}
+
+// describe entry of peer
+func describe[K comparable, C domain.Connection](peer K, e *cacheEntry[C]) domain.ConnectionInfo[K] {
+	return domain.ConnectionInfo[K]{
+		Peer:         peer,
+		Direction:    e.origin.direction,
+		Created:      e.created,
+		LastUsed:     e.lastUsedAt(),
+		DialDuration: e.origin.dialDuration,
+		Uses:         atomic.LoadUint64(&e.uses),
+	}
+}
+
+func (e *cacheEntry[C]) lastUsedAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&e.lastUsed))
+}
+
+// alive reports entry can be given to caller as is
+func (e *cacheEntry[C]) alive(policy expiryPolicy, now time.Time) bool {
+	return !e.expired(policy, now) && e.conn.State() == domain.StateOpen
+}
+
+// expired reports entry is idle or lives too long according to policy
+func (e *cacheEntry[C]) expired(policy expiryPolicy, now time.Time) bool {
+	if policy.idleTimeout > 0 && now.Sub(e.lastUsedAt()) >= policy.idleTimeout {
+		return true
+	}
+	if policy.maxLifetime > 0 && now.Sub(e.created) >= policy.maxLifetime {
+		return true
+	}
+	return false
+}
+
+// expiryPolicy decides when cached connection should be closed and removed
+type expiryPolicy struct {
+	idleTimeout  time.Duration
+	maxLifetime  time.Duration
+	reapInterval time.Duration
+}
+
+func (p expiryPolicy) enabled() bool {
+	return p.idleTimeout > 0 || p.maxLifetime > 0
+}
+
+// minReapInterval keeps reaping ticker valid and not busy for tiny limits
+const minReapInterval = time.Millisecond
+
+// interval of background reaping, half of the shortest limit if it is not set explicitly
+func (p expiryPolicy) interval() time.Duration {
+	if p.reapInterval > 0 {
+		return p.reapInterval
+	}
+	shortest := p.idleTimeout
+	if shortest <= 0 || (p.maxLifetime > 0 && p.maxLifetime < shortest) {
+		shortest = p.maxLifetime
+	}
+	if shortest/2 < minReapInterval {
+		return minReapInterval
+	}
+	return shortest / 2
+}
@@ -0,0 +1,24 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiryPolicy_Interval(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy expiryPolicy
+		want   time.Duration
+	}{
+		{name: "explicit", policy: expiryPolicy{idleTimeout: time.Minute, reapInterval: time.Second}, want: time.Second},
+		{name: "half of idle timeout", policy: expiryPolicy{idleTimeout: time.Minute}, want: 30 * time.Second},
+		{name: "half of shortest", policy: expiryPolicy{idleTimeout: time.Minute, maxLifetime: time.Second}, want: 500 * time.Millisecond},
+		{name: "tiny limit", policy: expiryPolicy{idleTimeout: 1}, want: minReapInterval},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, tt.policy.interval(), tt.name)
+	}
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// EntryStats describes usage of cached connection for EvictionPolicy
+type EntryStats struct {
+	Created  time.Time
+	LastUsed time.Time
+	Uses     uint64
+}
+
+// EvictionPolicy chooses which cached connection is closed when storage is full
+type EvictionPolicy interface {
+	// Before reports whether connection a should be evicted before b
+	Before(a, b EntryStats) bool
+}
+
+// EvictionPolicyFunc allows to use ordinary function as EvictionPolicy
+type EvictionPolicyFunc func(a, b EntryStats) bool
+
+func (f EvictionPolicyFunc) Before(a, b EntryStats) bool {
+	return f(a, b)
+}
+
+var (
+	// EvictLRU evicts least recently used connection
+	EvictLRU EvictionPolicy = EvictionPolicyFunc(func(a, b EntryStats) bool {
+		return a.LastUsed.Before(b.LastUsed)
+	})
+	// EvictLFU evicts least frequently used connection, older one if both are used equally
+	EvictLFU EvictionPolicy = EvictionPolicyFunc(func(a, b EntryStats) bool {
+		if a.Uses != b.Uses {
+			return a.Uses < b.Uses
+		}
+		return a.Created.Before(b.Created)
+	})
+	// EvictOldest evicts connection which was stored first
+	EvictOldest EvictionPolicy = EvictionPolicyFunc(func(a, b EntryStats) bool {
+		return a.Created.Before(b.Created)
+	})
+)
+
+// FullMode tells GetConnection what to do when storage is full and nothing can be evicted
+type FullMode int
+
+const (
+	// FullReject fails GetConnection with domain.ErrStorageFull
+	FullReject FullMode = iota
+	// FullBlock makes GetConnection wait for free slot until ctx is done
+	FullBlock
+)
+
+// capacityPolicy limits count of cached connections
+type capacityPolicy struct {
+	maxConns int
+	eviction EvictionPolicy
+	mode     FullMode
+}
+
+// hasRoom reports one more connection can be stored without eviction
+func (p capacityPolicy) hasRoom(size int) bool {
+	return p.maxConns <= 0 || size < p.maxConns
+}
+
+// pickVictim returns connection which should be evicted first, false if eviction is disabled
+func pickVictim[K comparable, C domain.Connection](policy EvictionPolicy, cache map[K]*cacheEntry[C]) (K, *cacheEntry[C], bool) {
+	var (
+		victimKey   K
+		victim      *cacheEntry[C]
+		victimStats EntryStats
+	)
+	if policy == nil {
+		return victimKey, nil, false
+	}
+
+	for key, entry := range cache {
+		stats := entry.stats()
+		if victim == nil || policy.Before(stats, victimStats) {
+			victimKey, victim, victimStats = key, entry, stats
+		}
+	}
+	return victimKey, victim, victim != nil
+}
+
+// slotPool counts connections cached by shards against limit of whole storage.
+// Nil pool has no limit
+type slotPool struct {
+	max int
+
+	mx    sync.Mutex
+	used  int
+	freed chan struct{} // is closed and replaced when slot is given back
+}
+
+func newSlotPool(max int) *slotPool {
+	if max <= 0 {
+		return nil
+	}
+	return &slotPool{max: max, freed: make(chan struct{})}
+}
+
+// take slot for new connection, returns false if all slots are used
+func (p *slotPool) take() bool {
+	if p == nil {
+		return true
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	if p.used >= p.max {
+		return false
+	}
+	p.used++
+	return true
+}
+
+// give slot back and wake up callers waiting for it
+func (p *slotPool) give() {
+	if p == nil {
+		return
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	p.used--
+	close(p.freed)
+	p.freed = make(chan struct{})
+}
+
+// full reports all slots are used and returns channel which is closed when slot is given back
+func (p *slotPool) full() (bool, <-chan struct{}) {
+	if p == nil {
+		return false, nil
+	}
+	p.mx.Lock()
+	defer p.mx.Unlock()
+
+	return p.used >= p.max, p.freed
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/aggregate"
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+func TestPickVictim(t *testing.T) {
+	now := time.Now()
+	newEntry := func(created, lastUsed time.Duration, uses uint64) *cacheEntry[domain.Connection] {
+		entry := newCacheEntry[domain.Connection](aggregate.NewFakeConnectionOpened(domain.PeerID{}), dialed(0), now.Add(created))
+		entry.touch(now.Add(lastUsed))
+		entry.uses = uses
+		return entry
+	}
+
+	cache := map[string]*cacheEntry[domain.Connection]{
+		"oldest":         newEntry(-3*time.Hour, -1*time.Minute, 10),
+		"least-recently": newEntry(-2*time.Hour, -5*time.Minute, 20),
+		"least-often":    newEntry(-1*time.Hour, -2*time.Minute, 1),
+	}
+
+	tests := []struct {
+		name   string
+		policy EvictionPolicy
+		victim string
+	}{
+		{name: "LRU", policy: EvictLRU, victim: "least-recently"},
+		{name: "LFU", policy: EvictLFU, victim: "least-often"},
+		{name: "oldest first", policy: EvictOldest, victim: "oldest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, entry, ok := pickVictim(tt.policy, cache)
+			assert.True(t, ok)
+			assert.Equal(t, tt.victim, key)
+			assert.Same(t, cache[tt.victim], entry)
+		})
+	}
+
+	t.Run("eviction disabled", func(t *testing.T) {
+		_, _, ok := pickVictim(nil, cache)
+		assert.False(t, ok)
+	})
+
+	t.Run("empty cache", func(t *testing.T) {
+		_, _, ok := pickVictim(EvictLRU, map[string]*cacheEntry[domain.Connection]{})
+		assert.False(t, ok)
+	})
+}
+
+func TestSlotPool(t *testing.T) {
+	pool := newSlotPool(2)
+	assert.True(t, pool.take())
+	assert.True(t, pool.take())
+	assert.False(t, pool.take())
+
+	full, freed := pool.full()
+	assert.True(t, full)
+	pool.give()
+	select {
+	case <-freed:
+	default:
+		t.Error("waiters are not woken up")
+	}
+	full, _ = pool.full()
+	assert.False(t, full)
+	assert.True(t, pool.take())
+
+	unlimited := newSlotPool(0)
+	assert.True(t, unlimited.take())
+	unlimited.give()
+	full, _ = unlimited.full()
+	assert.False(t, full)
+}
@@ -1,6 +1,11 @@
 package internal
 
 import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -11,7 +16,7 @@ import (
 	"github.com/goforbroke1006/unknown-livecoding-1/domain"
 )
 
-type InitStorageFn func() (storage domain.ConnectionsStorage, cancelFn func())
+type InitStorageFn func(opts ...StorageOption) (storage domain.ConnectionsStorage, cancelFn func())
 
 func NewTestSuite(t *testing.T, createFn InitStorageFn) {
 
@@ -23,7 +28,7 @@ func NewTestSuite(t *testing.T, createFn InitStorageFn) {
 
 		done := make(chan struct{})
 		go func() {
-			_ = cs.GetConnection(123)
+			_ = cs.GetConnection(domain.PeerFromInt32(123))
 			done <- struct{}{}
 		}()
 
@@ -38,7 +43,7 @@ func NewTestSuite(t *testing.T, createFn InitStorageFn) {
 	t.Run("same connection should be open once", func(t *testing.T) {
 		t.Parallel()
 
-		const ip = 123
+		ip := domain.PeerFromInt32(123)
 
 		cs, stop := createFn()
 		defer stop()
@@ -50,7 +55,7 @@ func NewTestSuite(t *testing.T, createFn InitStorageFn) {
 		)
 
 		go func() {
-			conn1 = cs.GetConnection(123)
+			conn1 = cs.GetConnection(domain.PeerFromInt32(123))
 			done <- struct{}{}
 		}()
 		select {
@@ -82,10 +87,1086 @@ func NewTestSuite(t *testing.T, createFn InitStorageFn) {
 		}
 	})
 
+	t.Run("concurrent callers share one dial", func(t *testing.T) {
+		t.Parallel()
+
+		const callers = 10
+		ip := domain.PeerFromInt32(124)
+
+		dials := int32(0)
+		release := make(chan struct{})
+		cs, stop := createFn(WithDialer(openedDialerWith(func(ctx context.Context, peer domain.PeerID) error {
+			atomic.AddInt32(&dials, 1)
+			<-release
+			return nil
+		})))
+		defer stop()
+
+		conns := make(chan domain.Connection, callers)
+		for i := 0; i < callers; i++ {
+			go func() { conns <- cs.GetConnection(ip) }()
+		}
+		<-time.After(50 * time.Millisecond) // let all callers start dial
+		close(release)
+
+		first := <-conns
+		assert.NotNil(t, first)
+		for i := 1; i < callers; i++ {
+			assert.Same(t, first, <-conns)
+		}
+		assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+	})
+
+	t.Run("GetConnectionContext gives up on deadline", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(456)
+
+		cs, stop := createFn()
+		defer stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		conn, err := cs.GetConnectionContext(ctx, ip)
+		assert.Nil(t, conn)
+		assert.True(t, errors.Is(err, context.DeadlineExceeded))
+		assert.Less(t, time.Since(start), time.Second)
+
+		var getErr *domain.GetConnectionError
+		if assert.True(t, errors.As(err, &getErr)) {
+			assert.Equal(t, ip, getErr.Peer)
+		}
+	})
+
+	t.Run("GetConnectionContext gives up on cancel", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(567)
+
+		cs, stop := createFn()
+		defer stop()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-time.After(50 * time.Millisecond)
+			cancel()
+		}()
+
+		conn, err := cs.GetConnectionContext(ctx, ip)
+		assert.Nil(t, conn)
+		assert.True(t, errors.Is(err, context.Canceled))
+	})
+
+	t.Run("custom dialer is used to open connection", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(678)
+
+		dialed := aggregate.NewFakeConnectionOpened(ip)
+		cs, stop := createFn(WithDialer(domain.ConnectionDialerFunc(func(ctx context.Context, peer domain.PeerID) (domain.Connection, error) {
+			return dialed, nil
+		})))
+		defer stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		conn, err := cs.GetConnectionContext(ctx, ip)
+		assert.Nil(t, err)
+		assert.Equal(t, domain.Connection(dialed), conn)
+	})
+
+	t.Run("dial error reaches every waiter and is not redialed immediately", func(t *testing.T) {
+		t.Parallel()
+
+		const waiters = 5
+		ip := domain.PeerFromInt32(789)
+
+		errDial := errors.New("connection refused")
+		dials := int32(0)
+		release := make(chan struct{})
+		cs, stop := createFn(WithDialer(domain.ConnectionDialerFunc(func(ctx context.Context, peer domain.PeerID) (domain.Connection, error) {
+			atomic.AddInt32(&dials, 1)
+			<-release
+			return nil, errDial
+		})))
+		defer stop()
+
+		results := make(chan error, waiters)
+		for i := 0; i < waiters; i++ {
+			go func() {
+				_, err := cs.GetConnectionContext(context.Background(), ip)
+				results <- err
+			}()
+		}
+		<-time.After(50 * time.Millisecond) // let all waiters subscribe
+		close(release)
+
+		for i := 0; i < waiters; i++ {
+			select {
+			case <-time.After(time.Second):
+				t.Fatal("waiter did not receive dial error")
+			case err := <-results:
+				assert.True(t, errors.Is(err, errDial))
+			}
+		}
+
+		dialsBefore := atomic.LoadInt32(&dials)
+		_, err := cs.GetConnectionContext(context.Background(), ip)
+		assert.True(t, errors.Is(err, errDial))
+		assert.Equal(t, dialsBefore, atomic.LoadInt32(&dials))
+	})
+
+	t.Run("failed dial is retried with backoff", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(790)
+
+		dials := int32(0)
+		cs, stop := createFn(
+			WithDialer(openedDialerWith(func(ctx context.Context, peer domain.PeerID) error {
+				if atomic.AddInt32(&dials, 1) < 3 {
+					return errors.New("connection refused")
+				}
+				return nil
+			})),
+			WithReconnect(5, 0),
+			WithReconnectBackoff(20*time.Millisecond, 100*time.Millisecond, 0.5),
+		)
+		defer stop()
+
+		start := time.Now()
+		conn, err := cs.GetConnectionContext(context.Background(), ip)
+		assert.Nil(t, err)
+		assert.True(t, conn.IsOpen())
+		assert.Equal(t, int32(3), atomic.LoadInt32(&dials))
+		assert.GreaterOrEqual(t, time.Since(start), 30*time.Millisecond) // 10ms + 20ms at least with jitter
+	})
+
+	t.Run("reconnect gives up when attempts are over", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(791)
+
+		errDial := errors.New("connection refused")
+		dials := int32(0)
+		cs, stop := createFn(
+			WithDialer(domain.ConnectionDialerFunc(func(ctx context.Context, peer domain.PeerID) (domain.Connection, error) {
+				atomic.AddInt32(&dials, 1)
+				return nil, errDial
+			})),
+			WithReconnect(3, 0),
+			WithReconnectBackoff(10*time.Millisecond, 10*time.Millisecond, 0),
+		)
+		defer stop()
+
+		_, err := cs.GetConnectionContext(context.Background(), ip)
+		assert.True(t, errors.Is(err, errDial))
+		assert.Equal(t, int32(3), atomic.LoadInt32(&dials))
+
+		_, err = cs.GetConnectionContext(context.Background(), ip)
+		assert.True(t, errors.Is(err, errDial))
+		assert.Equal(t, int32(3), atomic.LoadInt32(&dials))
+	})
+
+	t.Run("circuit breaker fails fast after repeated dial failures", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(792)
+
+		errDial := errors.New("connection refused")
+		var (
+			dials   int32
+			healthy int32
+		)
+		cs, stop := createFn(
+			WithDialer(openedDialerWith(func(ctx context.Context, peer domain.PeerID) error {
+				atomic.AddInt32(&dials, 1)
+				if atomic.LoadInt32(&healthy) == 0 {
+					return errDial
+				}
+				return nil
+			})),
+			WithReconnect(2, 0),
+			WithReconnectBackoff(10*time.Millisecond, 10*time.Millisecond, 0),
+			WithCircuitBreaker(2, 1500*time.Millisecond),
+		)
+		defer stop()
+
+		breaker := cs.(interface {
+			CircuitState(peer domain.PeerID) BreakerState
+		})
+
+		_, err := cs.GetConnectionContext(context.Background(), ip)
+		assert.True(t, errors.Is(err, errDial))
+		assert.Equal(t, int32(2), atomic.LoadInt32(&dials))
+		assert.Equal(t, BreakerOpen, breaker.CircuitState(ip))
+
+		<-time.After(dialFailureTTL) // recent dial error is not returned anymore
+		_, err = cs.GetConnectionContext(context.Background(), ip)
+		assert.True(t, errors.Is(err, domain.ErrCircuitOpen))
+		assert.Equal(t, int32(2), atomic.LoadInt32(&dials))
+
+		atomic.StoreInt32(&healthy, 1)
+		assert.Eventually(t, func() bool {
+			return breaker.CircuitState(ip) == BreakerHalfOpen
+		}, 2*time.Second, 50*time.Millisecond)
+
+		conn, err := cs.GetConnectionContext(context.Background(), ip)
+		assert.Nil(t, err)
+		assert.True(t, conn.IsOpen())
+		assert.Equal(t, int32(3), atomic.LoadInt32(&dials))
+		assert.Equal(t, BreakerClosed, breaker.CircuitState(ip))
+	})
+
+	t.Run("concurrent dials are limited", func(t *testing.T) {
+		t.Parallel()
+
+		const (
+			peers = 6
+			limit = 2
+		)
+
+		var inFlight, maxInFlight int32
+		cs, stop := createFn(
+			WithDialer(openedDialerWith(func(ctx context.Context, peer domain.PeerID) error {
+				n := atomic.AddInt32(&inFlight, 1)
+				defer atomic.AddInt32(&inFlight, -1)
+				for max := atomic.LoadInt32(&maxInFlight); n > max; max = atomic.LoadInt32(&maxInFlight) {
+					if atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+						break
+					}
+				}
+				<-time.After(50 * time.Millisecond)
+				return nil
+			})),
+			WithDialLimits(limit, 1),
+		)
+		defer stop()
+
+		results := make(chan error, peers)
+		for i := 0; i < peers; i++ {
+			go func(ip domain.PeerID) {
+				_, err := cs.GetConnectionContext(context.Background(), ip)
+				results <- err
+			}(domain.PeerFromInt32(int32(800 + i)))
+		}
+		for i := 0; i < peers; i++ {
+			select {
+			case <-time.After(2 * time.Second):
+				t.Fatal("queued dial was not done")
+			case err := <-results:
+				assert.Nil(t, err)
+			}
+		}
+
+		assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(limit))
+		stats := cs.(interface{ Stats() Stats }).Stats()
+		assert.GreaterOrEqual(t, stats.DialQueueWaits, uint64(peers-limit))
+		assert.Greater(t, stats.DialQueueWaitTotal, time.Duration(0))
+		assert.Equal(t, int64(0), stats.DialsQueued)
+	})
+
+	t.Run("outbound connection over loopback", func(t *testing.T) {
+		t.Parallel()
+
+		echo, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer echo.Close()
+		go func() {
+			for {
+				conn, err := echo.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					_, _ = io.Copy(conn, conn)
+				}()
+			}
+		}()
+
+		loopback := domain.PeerFromAddr(netip.MustParseAddr("127.0.0.1"))
+		port := uint16(echo.Addr().(*net.TCPAddr).Port)
+		cs, stop := createFn(WithDialer(aggregate.NewTCPDialer(aggregate.PeerAddress(port), aggregate.WithDialTimeout(time.Second))))
+		defer stop()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		conn, err := cs.GetConnectionContext(ctx, loopback)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tcpConn := conn.(*aggregate.TCPConnection)
+		assert.True(t, tcpConn.IsOpen())
+
+		_, err = tcpConn.Write([]byte("ping"))
+		assert.Nil(t, err)
+		reply := make([]byte, 4)
+		_, err = io.ReadFull(tcpConn, reply)
+		assert.Nil(t, err)
+		assert.Equal(t, "ping", string(reply))
+	})
+
+	t.Run("inbound connection over loopback", func(t *testing.T) {
+		t.Parallel()
+
+		loopback := domain.PeerFromAddr(netip.MustParseAddr("127.0.0.1"))
+		cs, stop := createFn(WithDialer(domain.ConnectionDialerFunc(func(ctx context.Context, peer domain.PeerID) (domain.Connection, error) {
+			<-ctx.Done() // only inbound connection is expected
+			return nil, ctx.Err()
+		})))
+		defer stop()
+
+		listener, err := aggregate.ListenTCP("127.0.0.1:0", cs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() { _ = listener.Serve() }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		result := make(chan domain.Connection)
+		go func() {
+			conn, _ := cs.GetConnectionContext(ctx, loopback)
+			result <- conn
+		}()
+
+		client, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn := <-result
+		if conn == nil {
+			t.Fatal("inbound connection was not handed to storage")
+		}
+		assert.True(t, conn.IsOpen())
+
+		// remote side is gone, socket state should be reflected after read
+		_ = client.Close()
+		_, err = conn.(*aggregate.TCPConnection).Read(make([]byte, 1))
+		assert.NotNil(t, err)
+		assert.False(t, conn.IsOpen())
+	})
+
+	t.Run("idle connection is closed and redialed", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(890)
+
+		cs, stop := createFn(
+			WithDialer(openedDialer()),
+			WithIdleTimeout(100*time.Millisecond),
+			WithReapInterval(20*time.Millisecond),
+		)
+		defer stop()
+
+		conn1 := cs.GetConnection(ip)
+		for i := 0; i < 5; i++ { // being used connection stays in cache
+			<-time.After(40 * time.Millisecond)
+			assert.Same(t, conn1, cs.GetConnection(ip))
+		}
+
+		<-time.After(200 * time.Millisecond)
+		assert.Eventually(t, func() bool { return !conn1.IsOpen() }, 2*time.Second, 50*time.Millisecond)
+
+		conn2 := cs.GetConnection(ip)
+		assert.NotSame(t, conn1, conn2)
+		assert.True(t, conn2.IsOpen())
+	})
+
+	t.Run("connection is redialed after max lifetime", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(901)
+
+		cs, stop := createFn(
+			WithDialer(openedDialer()),
+			WithMaxLifetime(150*time.Millisecond),
+		)
+		defer stop()
+
+		conn1 := cs.GetConnection(ip)
+		var conn2 domain.Connection
+		for i := 0; i < 10; i++ {
+			<-time.After(40 * time.Millisecond)
+			if conn2 = cs.GetConnection(ip); conn2 != conn1 {
+				break
+			}
+		}
+		assert.NotSame(t, conn1, conn2, "connection lives longer than max lifetime")
+		assert.Eventually(t, func() bool { return !conn1.IsOpen() }, 2*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("full storage evicts least recently used connection", func(t *testing.T) {
+		t.Parallel()
+
+		peerA, peerB, peerC := domain.PeerFromInt32(1001), domain.PeerFromInt32(1002), domain.PeerFromInt32(1003)
+
+		cs, stop := createFn(
+			WithDialer(openedDialer()),
+			WithMaxConnections(2),
+		)
+		defer stop()
+
+		connA := cs.GetConnection(peerA)
+		connB := cs.GetConnection(peerB)
+		<-time.After(time.Millisecond)
+		assert.Same(t, connA, cs.GetConnection(peerA)) // B is least recently used now
+
+		connC := cs.GetConnection(peerC)
+		assert.NotNil(t, connC)
+		assert.Eventually(t, func() bool { return !connB.IsOpen() }, 2*time.Second, 50*time.Millisecond)
+		assert.True(t, connA.IsOpen())
+		assert.Same(t, connA, cs.GetConnection(peerA))
+	})
+
+	t.Run("full storage rejects new peer when eviction is disabled", func(t *testing.T) {
+		t.Parallel()
+
+		cs, stop := createFn(
+			WithDialer(openedDialer()),
+			WithMaxConnections(1),
+			WithEvictionPolicy(nil),
+		)
+		defer stop()
+
+		_, err := cs.GetConnectionContext(context.Background(), domain.PeerFromInt32(1101))
+		assert.Nil(t, err)
+
+		_, err = cs.GetConnectionContext(context.Background(), domain.PeerFromInt32(1102))
+		assert.True(t, errors.Is(err, domain.ErrStorageFull))
+	})
+
+	t.Run("full storage blocks new peer until slot is freed", func(t *testing.T) {
+		t.Parallel()
+
+		cs, stop := createFn(
+			WithDialer(openedDialer()),
+			WithMaxConnections(1),
+			WithEvictionPolicy(nil),
+			WithFullMode(FullBlock),
+			WithIdleTimeout(300*time.Millisecond),
+			WithReapInterval(20*time.Millisecond),
+		)
+		defer stop()
+
+		_ = cs.GetConnection(domain.PeerFromInt32(1201))
+
+		done := make(chan error)
+		go func() {
+			_, err := cs.GetConnectionContext(context.Background(), domain.PeerFromInt32(1202))
+			done <- err
+		}()
+
+		select {
+		case <-time.After(100 * time.Millisecond):
+			// ok, still blocked
+		case <-done:
+			t.Fatal("should wait for free slot")
+		}
+
+		select {
+		case <-time.After(2 * time.Second):
+			t.Fatal("should get connection after idle one is reaped")
+		case err := <-done:
+			assert.Nil(t, err)
+		}
+	})
+
+	t.Run("dead cached connection is redialed", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(1301)
+
+		cs, stop := createFn(
+			WithDialer(openedDialer()),
+		)
+		defer stop()
+
+		conn1 := cs.GetConnection(ip)
+		_ = conn1.Close()
+
+		conn2 := cs.GetConnection(ip)
+		assert.NotSame(t, conn1, conn2)
+		assert.True(t, conn2.IsOpen())
+		assert.Same(t, conn2, cs.GetConnection(ip))
+		assert.Equal(t, uint64(1), cs.(interface{ Stats() Stats }).Stats().StaleRepaired)
+	})
+
+	t.Run("remote connection which is not open is refused", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(1304)
+
+		release := make(chan struct{})
+		cs, stop := createFn(
+			WithDialer(openedDialerWith(func(ctx context.Context, peer domain.PeerID) error {
+				<-release
+				return nil
+			})),
+		)
+		defer stop()
+
+		dialed := make(chan domain.Connection, 1)
+		go func() { dialed <- cs.GetConnection(ip) }()
+
+		idle := aggregate.NewConnection(ip)
+		cs.OnNewRemoteConnection(ip, idle)
+		_, cached := cs.Peek(ip)
+		assert.False(t, cached)
+
+		close(release)
+		conn := <-dialed
+		assert.NotSame(t, idle, conn, "waiter does not get connection which read would evict")
+		assert.True(t, conn.IsOpen())
+		assert.Same(t, conn, cs.GetConnection(ip))
+		assert.Equal(t, uint64(0), cs.(interface{ Stats() Stats }).Stats().StaleRepaired)
+		assert.Eventually(t, func() bool { return idle.State() == domain.StateClosed }, 2*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("connection failed health probe is redialed", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(1302)
+
+		var broken atomic.Value
+		cs, stop := createFn(
+			WithDialer(openedDialer()),
+			WithHealthProbe(func(ctx context.Context, conn domain.Connection) error {
+				if broken.Load() == conn {
+					return errors.New("no pong")
+				}
+				return nil
+			}),
+		)
+		defer stop()
+
+		conn1 := cs.GetConnection(ip)
+		assert.Same(t, conn1, cs.GetConnection(ip))
+
+		broken.Store(conn1)
+		conn2 := cs.GetConnection(ip)
+		assert.NotSame(t, conn1, conn2)
+		assert.Equal(t, uint64(1), cs.(interface{ Stats() Stats }).Stats().StaleRepaired)
+		assert.Eventually(t, func() bool { return !conn1.IsOpen() }, 2*time.Second, 50*time.Millisecond)
+	})
+
+	t.Run("background health check redials unhealthy peer", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(1303)
+
+		var (
+			dials  int32
+			broken atomic.Value
+		)
+		cs, stop := createFn(
+			WithDialer(openedDialerWith(func(ctx context.Context, peer domain.PeerID) error {
+				if atomic.AddInt32(&dials, 1) == 2 { // first redial attempt fails, next one is backed off
+					return errors.New("connection refused")
+				}
+				return nil
+			})),
+			WithHealthProbe(func(ctx context.Context, conn domain.Connection) error {
+				if broken.Load() == conn {
+					return errors.New("no pong")
+				}
+				return nil
+			}),
+			WithHealthCheck(50*time.Millisecond),
+			WithReconnect(3, 0),
+		)
+		defer stop()
+
+		health := cs.(interface {
+			HealthOf(peer domain.PeerID) (ProbeResult, bool)
+		})
+
+		conn1 := cs.GetConnection(ip)
+		assert.Eventually(t, func() bool {
+			result, found := health.HealthOf(ip)
+			return found && result.Healthy() && !result.At.IsZero()
+		}, 2*time.Second, 10*time.Millisecond)
+
+		broken.Store(conn1)
+		assert.Eventually(t, func() bool {
+			result, found := health.HealthOf(ip)
+			return found && !result.Healthy()
+		}, 2*time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool { return !conn1.IsOpen() }, 2*time.Second, 10*time.Millisecond)
+
+		// redialed without any GetConnection call
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&dials) == 3 }, 2*time.Second, 10*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			result, found := health.HealthOf(ip)
+			return found && result.Healthy()
+		}, 2*time.Second, 10*time.Millisecond)
+
+		conn3 := cs.GetConnection(ip)
+		assert.NotSame(t, conn1, conn3)
+		assert.True(t, conn3.IsOpen())
+		assert.Equal(t, int32(3), atomic.LoadInt32(&dials))
+	})
+
+	t.Run("simultaneous open is resolved by tie-break policy", func(t *testing.T) {
+		t.Parallel()
+
+		lowerLocal, higherLocal := domain.PeerFromInt32(1400), domain.PeerFromInt32(1499)
+		for i, tt := range []struct {
+			policy TieBreakPolicy[domain.PeerID]
+			keep   domain.Direction
+		}{
+			{policy: PreferInbound[domain.PeerID](), keep: domain.Inbound},
+			{policy: PreferOutbound[domain.PeerID](), keep: domain.Outbound},
+			{policy: TieBreakByPeerID(lowerLocal, domain.PeerID.Compare), keep: domain.Outbound},
+			{policy: TieBreakByPeerID(higherLocal, domain.PeerID.Compare), keep: domain.Inbound},
+		} {
+			ip := domain.PeerFromInt32(int32(1401 + i))
+
+			dialStarted, release := make(chan struct{}), make(chan struct{})
+			outbound := aggregate.NewFakeConnectionOpened(ip)
+			cs, stop := createFn(
+				WithDialer(domain.ConnectionDialerFunc(func(ctx context.Context, peer domain.PeerID) (domain.Connection, error) {
+					close(dialStarted)
+					<-release
+					return outbound, nil
+				})),
+				WithTieBreak(tt.policy),
+			)
+			ctx, cancel := context.WithCancel(context.Background())
+			closed := cs.(interface {
+				Watch(ctx context.Context, filter WatchFilter[domain.PeerID]) <-chan domain.Event[domain.PeerID]
+			}).Watch(ctx, WatchFilter[domain.PeerID]{Peers: []domain.PeerID{ip}, Kinds: []domain.EventKind{domain.EventClosed}})
+
+			dialed := make(chan domain.Connection, 1)
+			go func() { dialed <- cs.GetConnection(ip) }()
+			<-dialStarted
+
+			// remote side dials us at the same time, waiting caller takes its connection and leaves
+			inbound := aggregate.NewFakeConnectionOpened(ip)
+			cs.OnNewRemoteConnection(ip, inbound)
+			assert.Same(t, inbound, <-dialed)
+			close(release) // dial is finished after caller left and is resolved by policy
+
+			winner, loser, lost := inbound, outbound, domain.Outbound
+			if tt.keep == domain.Outbound {
+				winner, loser, lost = outbound, inbound, domain.Inbound
+			}
+			assert.Eventually(t, func() bool { return !loser.IsOpen() }, 2*time.Second, 10*time.Millisecond,
+				"%s connection should be closed", lost)
+			assert.Same(t, winner, cs.GetConnection(ip))
+			assert.True(t, winner.IsOpen())
+			if tt.keep == domain.Inbound { // arrived outbound connection is rejected, it is reported too
+				event := <-closed
+				assert.Equal(t, domain.Outbound, event.Direction)
+			}
+			cancel()
+			stop()
+		}
+	})
+
+	t.Run("cached connections are described", func(t *testing.T) {
+		t.Parallel()
+
+		dialedIP, remoteIP := domain.PeerFromInt32(1501), domain.PeerFromInt32(1502)
+
+		cs, stop := createFn(
+			WithDialer(openedDialerAfter(30 * time.Millisecond)),
+		)
+		defer stop()
+
+		describer := cs.(interface {
+			Describe(peer domain.PeerID) (domain.ConnectionInfo[domain.PeerID], bool)
+			Snapshot() []domain.ConnectionInfo[domain.PeerID]
+		})
+
+		_, found := describer.Describe(dialedIP)
+		assert.False(t, found)
+
+		before := time.Now()
+		for i := 0; i < 3; i++ {
+			cs.GetConnection(dialedIP)
+		}
+		cs.OnNewRemoteConnection(remoteIP, aggregate.NewFakeConnectionOpened(remoteIP))
+
+		info, found := describer.Describe(dialedIP)
+		assert.True(t, found)
+		assert.Equal(t, dialedIP, info.Peer)
+		assert.Equal(t, domain.Outbound, info.Direction)
+		assert.GreaterOrEqual(t, info.DialDuration, 30*time.Millisecond)
+		assert.Equal(t, uint64(2), info.Uses)
+		assert.False(t, info.Created.Before(before))
+		assert.False(t, info.LastUsed.Before(info.Created))
+
+		info, found = describer.Describe(remoteIP)
+		assert.True(t, found)
+		assert.Equal(t, domain.Inbound, info.Direction)
+		assert.Zero(t, info.DialDuration)
+		assert.Zero(t, info.Uses)
+
+		snapshot := describer.Snapshot()
+		assert.Len(t, snapshot, 2)
+		peers := make([]domain.PeerID, 0, len(snapshot))
+		for _, info := range snapshot {
+			peers = append(peers, info.Peer)
+		}
+		assert.ElementsMatch(t, []domain.PeerID{dialedIP, remoteIP}, peers)
+	})
+
+	t.Run("cached connections are listed and removed without dialing", func(t *testing.T) {
+		t.Parallel()
+
+		peers := []domain.PeerID{domain.PeerFromInt32(1601), domain.PeerFromInt32(1602), domain.PeerFromInt32(1603)}
+		missing := domain.PeerFromInt32(1604)
+
+		dials := int32(0)
+		cs, stop := createFn(WithDialer(openedDialerWith(func(ctx context.Context, peer domain.PeerID) error {
+			atomic.AddInt32(&dials, 1)
+			return nil
+		})))
+		defer stop()
+
+		assert.Equal(t, 0, cs.Len())
+		conns := make(map[domain.PeerID]domain.Connection)
+		for _, ip := range peers {
+			conns[ip] = cs.GetConnection(ip)
+		}
+		assert.Equal(t, 3, cs.Len())
+
+		conn, found := cs.Peek(peers[0])
+		assert.True(t, found)
+		assert.Same(t, conns[peers[0]], conn)
+		_, found = cs.Peek(missing)
+		assert.False(t, found)
+
+		ranged := make(map[domain.PeerID]domain.Connection)
+		cs.Range(func(peer domain.PeerID, conn domain.Connection) bool {
+			ranged[peer] = conn
+			cs.Len() // storage may be called from fn
+			return true
+		})
+		assert.Equal(t, conns, ranged)
+
+		visited := 0
+		cs.Range(func(peer domain.PeerID, conn domain.Connection) bool {
+			visited++
+			return false
+		})
+		assert.Equal(t, 1, visited)
+
+		assert.True(t, cs.Disconnect(peers[1]))
+		assert.False(t, cs.Disconnect(peers[1]))
+		assert.False(t, cs.Disconnect(missing))
+		assert.Equal(t, 2, cs.Len())
+		_, found = cs.Peek(peers[1])
+		assert.False(t, found)
+		assert.Eventually(t, func() bool { return !conns[peers[1]].IsOpen() }, 2*time.Second, 50*time.Millisecond)
+		assert.Equal(t, int32(len(peers)), atomic.LoadInt32(&dials))
+
+		assert.NotSame(t, conns[peers[1]], cs.GetConnection(peers[1]))
+		assert.Equal(t, int32(len(peers)+1), atomic.LoadInt32(&dials))
+	})
+
+	t.Run("lifecycle events are watched", func(t *testing.T) {
+		t.Parallel()
+
+		ip, failingIP := domain.PeerFromInt32(1701), domain.PeerFromInt32(1702)
+
+		errDial := errors.New("connection refused")
+		cs, stop := createFn(WithDialer(openedDialerWith(func(ctx context.Context, peer domain.PeerID) error {
+			if peer == failingIP {
+				return errDial
+			}
+			return nil
+		})))
+		defer stop()
+
+		watcher := cs.(interface {
+			Watch(ctx context.Context, filter WatchFilter[domain.PeerID]) <-chan domain.Event[domain.PeerID]
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		events := watcher.Watch(ctx, WatchFilter[domain.PeerID]{Peers: []domain.PeerID{ip}})
+		failures := watcher.Watch(ctx, WatchFilter[domain.PeerID]{Kinds: []domain.EventKind{domain.EventDialFailed}})
+
+		cs.GetConnection(ip)
+		cs.OnNewRemoteConnection(ip, aggregate.NewFakeConnectionOpened(ip))
+		cs.Disconnect(ip)
+		_, _ = cs.GetConnectionContext(context.Background(), failingIP)
+
+		for _, want := range []struct {
+			kind      domain.EventKind
+			direction domain.Direction
+		}{
+			{kind: domain.EventDialing, direction: domain.Outbound},
+			{kind: domain.EventOpened, direction: domain.Outbound},
+			{kind: domain.EventReplaced, direction: domain.Inbound},
+			{kind: domain.EventClosed, direction: domain.Inbound},
+		} {
+			select {
+			case <-time.After(time.Second):
+				t.Fatalf("no %s event", want.kind)
+			case event := <-events:
+				assert.Equal(t, want.kind, event.Kind)
+				assert.Equal(t, want.direction, event.Direction)
+				assert.Equal(t, ip, event.Peer)
+			}
+		}
+
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("no dial failed event")
+		case event := <-failures:
+			assert.Equal(t, failingIP, event.Peer)
+			assert.True(t, errors.Is(event.Err, errDial))
+		}
+
+		cancel()
+		assert.Eventually(t, func() bool {
+			_, ok := <-events
+			return !ok
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("leased connection is closed only after release", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(1801)
+
+		cs, stop := createFn(
+			WithDialer(openedDialer()),
+			WithLeaseLeakThreshold(100*time.Millisecond),
+		)
+		defer stop()
+
+		leaser := cs.(interface {
+			LeakedLeases() []LeaseInfo[domain.PeerID]
+		})
+
+		lease1, err := cs.Acquire(context.Background(), ip)
+		assert.Nil(t, err)
+		lease2, err := cs.Acquire(context.Background(), ip)
+		assert.Nil(t, err)
+		borrowed := lease1.Conn()
+		assert.Same(t, borrowed, lease2.Conn())
+
+		remote := aggregate.NewFakeConnectionOpened(ip)
+		cs.OnNewRemoteConnection(ip, remote)
+		assert.Same(t, remote, cs.GetConnection(ip))
+
+		assert.Eventually(t, func() bool {
+			leaked := leaser.LeakedLeases()
+			return len(leaked) == 2 && leaked[0].Peer == ip && leaked[0].Held >= 100*time.Millisecond
+		}, 2*time.Second, 20*time.Millisecond)
+		assert.Equal(t, domain.StateOpen, borrowed.State(), "replaced connection is still borrowed")
+
+		lease1.Release()
+		lease1.Release() // repeated release does not count
+		<-time.After(50 * time.Millisecond)
+		assert.Equal(t, domain.StateOpen, borrowed.State(), "replaced connection is still borrowed")
+		assert.Len(t, leaser.LeakedLeases(), 1)
+
+		lease2.Release()
+		assert.Eventually(t, func() bool { return borrowed.State() != domain.StateOpen }, time.Second, 10*time.Millisecond)
+		assert.Empty(t, leaser.LeakedLeases())
+		assert.True(t, remote.IsOpen())
+	})
+
+	t.Run("shutdown aborts dials, closes connections and rejects new callers", func(t *testing.T) {
+		t.Parallel()
+
+		dialedIP, remoteIP := domain.PeerFromInt32(1901), domain.PeerFromInt32(1902)
+
+		dialing, aborted := make(chan struct{}), make(chan struct{})
+		cs, stop := createFn(WithDialer(domain.ConnectionDialerFunc(func(ctx context.Context, peer domain.PeerID) (domain.Connection, error) {
+			close(dialing)
+			<-ctx.Done()
+			close(aborted)
+			return nil, ctx.Err()
+		})))
+		defer stop()
+
+		remote := aggregate.NewFakeConnectionOpened(remoteIP)
+		cs.OnNewRemoteConnection(remoteIP, remote)
+
+		waitErr := make(chan error, 1)
+		go func() {
+			_, err := cs.GetConnectionContext(context.Background(), dialedIP)
+			waitErr <- err
+		}()
+		<-dialing
+
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		defer cancel()
+		assert.Nil(t, cs.Shutdown(ctx))
+		assert.Equal(t, domain.StateClosed, remote.State())
+
+		assert.ErrorIs(t, <-waitErr, domain.ErrStorageClosed)
+		select {
+		case <-aborted:
+		case <-time.After(time.Second):
+			t.Error("in-flight dial is not cancelled")
+		}
+
+		_, err := cs.GetConnectionContext(context.Background(), remoteIP)
+		assert.ErrorIs(t, err, domain.ErrStorageClosed)
+		assert.Nil(t, cs.Shutdown(ctx), "repeated shutdown")
+	})
+
+	t.Run("shutdown reports connections not closed before deadline", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(1903)
+
+		cs, stop := createFn(WithDialer(openedDialer()))
+		defer stop()
+
+		lease, err := cs.Acquire(context.Background(), ip)
+		assert.Nil(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		err = cs.Shutdown(ctx)
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		var shutdownErr *domain.ShutdownError
+		if assert.ErrorAs(t, err, &shutdownErr) {
+			assert.Len(t, shutdownErr.Failed, 1)
+			assert.ErrorIs(t, shutdownErr.Failed[ip], context.DeadlineExceeded)
+		}
+		assert.True(t, lease.Conn().IsOpen(), "leased connection is not closed")
+
+		lease.Release()
+		assert.Nil(t, cs.Shutdown(context.Background()))
+		assert.Equal(t, domain.StateClosed, lease.Conn().State())
+	})
+
+	t.Run("storage is done after shutdown and run returns", func(t *testing.T) {
+		t.Parallel()
+
+		cs, stop := createFn(WithDialer(openedDialer()))
+		defer stop()
+
+		conn := cs.GetConnection(domain.PeerFromInt32(1911))
+		select {
+		case <-cs.Done():
+			t.Fatal("storage is done before shutdown")
+		default:
+		}
+
+		const callers = 3
+		results := make(chan error, callers)
+		for i := 0; i < callers; i++ {
+			go func() { results <- cs.Shutdown(context.Background()) }()
+		}
+		for i := 0; i < callers; i++ {
+			assert.Nil(t, <-results, "every shutdown call waits for connections")
+			assert.Equal(t, domain.StateClosed, conn.State())
+		}
+
+		select {
+		case <-cs.Done():
+		default:
+			t.Error("storage is not done after shutdown")
+		}
+
+		returned := make(chan struct{})
+		go func() {
+			cs.Run() // second run of shut down storage
+			close(returned)
+		}()
+		select {
+		case <-returned:
+		case <-time.After(time.Second):
+			t.Error("run does not return after shutdown")
+		}
+		assert.Equal(t, 0, cs.Len())
+	})
+
+	t.Run("background maintenance stops on shutdown", func(t *testing.T) {
+		t.Parallel()
+
+		ip := domain.PeerFromInt32(1912)
+
+		probes := int32(0)
+		cs, stop := createFn(
+			WithDialer(openedDialer()),
+			WithHealthProbe(func(ctx context.Context, conn domain.Connection) error {
+				atomic.AddInt32(&probes, 1)
+				return nil
+			}),
+			WithHealthCheck(20*time.Millisecond),
+		)
+		defer stop()
+
+		_ = cs.GetConnection(ip)
+		assert.Eventually(t, func() bool { return atomic.LoadInt32(&probes) > 1 }, time.Second, 10*time.Millisecond)
+
+		assert.Nil(t, cs.Shutdown(context.Background()))
+		stopped := atomic.LoadInt32(&probes)
+		<-time.After(100 * time.Millisecond)
+		assert.Equal(t, stopped, atomic.LoadInt32(&probes))
+	})
+
+	t.Run("batch resolves hits at once and dials misses in parallel", func(t *testing.T) {
+		t.Parallel()
+
+		const dialDuration = 200 * time.Millisecond
+		cached, failing := domain.PeerFromInt32(2001), domain.PeerFromInt32(2002)
+		missing := []domain.PeerID{domain.PeerFromInt32(2003), domain.PeerFromInt32(2004), domain.PeerFromInt32(2005)}
+		dialErr := errors.New("connection refused")
+
+		dials := int32(0)
+		cs, stop := createFn(
+			WithDialer(openedDialerWith(func(ctx context.Context, peer domain.PeerID) error {
+				atomic.AddInt32(&dials, 1)
+				<-time.After(dialDuration)
+				if peer == failing {
+					return dialErr
+				}
+				return nil
+			})),
+			WithDialLimits(2, 0),
+		)
+		defer stop()
+
+		remote := aggregate.NewFakeConnectionOpened(cached)
+		cs.OnNewRemoteConnection(cached, remote)
+
+		peers := append([]domain.PeerID{cached, failing, cached}, missing...)
+		start := time.Now()
+		results := cs.GetConnections(context.Background(), peers)
+		elapsed := time.Since(start)
+
+		assert.Len(t, results, 5)
+		assert.Nil(t, results[cached].Err)
+		assert.Same(t, remote, results[cached].Conn)
+		assert.True(t, errors.Is(results[failing].Err, dialErr))
+		var getErr *domain.GetConnectionError
+		assert.True(t, errors.As(results[failing].Err, &getErr))
+		for _, peer := range missing {
+			if assert.Nil(t, results[peer].Err) {
+				assert.True(t, results[peer].Conn.IsOpen())
+			}
+		}
+
+		assert.Equal(t, int32(4), atomic.LoadInt32(&dials))
+		assert.GreaterOrEqual(t, elapsed, 2*dialDuration, "dial limit is kept")
+		assert.Less(t, elapsed, 4*dialDuration, "misses are dialed in parallel")
+	})
+
 	t.Run("OnNewRemoteConnection + GetConnection(immediately)", func(t *testing.T) {
 		t.Parallel()
 
-		const ip = 234
+		ip := domain.PeerFromInt32(234)
 
 		var (
 			remoteConn   domain.Connection = nil
@@ -96,7 +1177,7 @@ func NewTestSuite(t *testing.T, createFn InitStorageFn) {
 		cs, stop := createFn()
 		defer stop()
 
-		remoteConn = aggregate.NewConnection(ip)
+		remoteConn = aggregate.NewFakeConnectionOpened(ip)
 		cs.OnNewRemoteConnection(ip, remoteConn)
 
 		go func() {
@@ -118,7 +1199,7 @@ func NewTestSuite(t *testing.T, createFn InitStorageFn) {
 	t.Run("GetConnection + OnNewRemoteConnection (immediately return from GetConnection)", func(t *testing.T) {
 		t.Parallel()
 
-		const ip = 234
+		ip := domain.PeerFromInt32(234)
 
 		var (
 			remoteConn   domain.Connection = nil
@@ -130,7 +1211,7 @@ func NewTestSuite(t *testing.T, createFn InitStorageFn) {
 		cs, stop := createFn()
 		defer stop()
 
-		remoteConn = aggregate.NewConnection(ip)
+		remoteConn = aggregate.NewFakeConnectionOpened(ip)
 
 		go func() {
 			start <- struct{}{}
@@ -160,7 +1241,7 @@ func NewTestSuite(t *testing.T, createFn InitStorageFn) {
 	t.Run("OnNewRemoteConnection + GetConnection + OnNewRemoteConnection+Connection.Close() + GetConnection - old closed, new opened", func(t *testing.T) {
 		t.Parallel()
 
-		const ip = 345
+		ip := domain.PeerFromInt32(345)
 
 		var (
 			remoteConn1   domain.Connection = nil
@@ -216,8 +1297,121 @@ func NewTestSuite(t *testing.T, createFn InitStorageFn) {
 	})
 }
 
+// resource is not a network connection, it checks storages keep any kind of per-peer resource
+type resource struct {
+	name     string
+	closed   int32
+	closeErr error
+}
+
+func (r *resource) Open(ctx context.Context) error { return nil }
+func (r *resource) Close() error                   { atomic.StoreInt32(&r.closed, 1); return r.closeErr }
+func (r *resource) IsOpen() bool                   { return r.State() == domain.StateOpen }
+func (r *resource) State() domain.State {
+	if atomic.LoadInt32(&r.closed) == 1 {
+		return domain.StateClosed
+	}
+	return domain.StateOpen
+}
+
+type InitGenericStorageFn func(dialer domain.Dialer[string, *resource]) (storage domain.Storage[string, *resource], cancelFn func())
+
+func NewGenericTestSuite(t *testing.T, createFn InitGenericStorageFn) {
+
+	t.Run("typed resource is dialed once per key", func(t *testing.T) {
+		t.Parallel()
+
+		dials := int32(0)
+		cs, stop := createFn(domain.DialerFunc[string, *resource](func(ctx context.Context, key string) (*resource, error) {
+			atomic.AddInt32(&dials, 1)
+			return &resource{name: key}, nil
+		}))
+		defer stop()
+
+		first := cs.GetConnection("db-primary")
+		if first == nil {
+			t.Fatal("should not be NIL")
+		}
+		assert.Equal(t, "db-primary", first.name)
+
+		second, err := cs.GetConnectionContext(context.Background(), "db-primary")
+		assert.Nil(t, err)
+		assert.Same(t, first, second)
+		assert.Equal(t, int32(1), atomic.LoadInt32(&dials))
+	})
+
+	t.Run("remote resource replaces cached one", func(t *testing.T) {
+		t.Parallel()
+
+		cs, stop := createFn(domain.DialerFunc[string, *resource](func(ctx context.Context, key string) (*resource, error) {
+			return &resource{name: key}, nil
+		}))
+		defer stop()
+
+		old := cs.GetConnection("cache")
+		remote := &resource{name: "cache"}
+		cs.OnNewRemoteConnection("cache", remote)
+
+		assert.Same(t, remote, cs.GetConnection("cache"))
+		assert.Eventually(t, func() bool { return !old.IsOpen() }, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("resource failed to close is reported on shutdown", func(t *testing.T) {
+		t.Parallel()
+
+		closeErr := errors.New("broken pipe")
+		cs, stop := createFn(domain.DialerFunc[string, *resource](func(ctx context.Context, key string) (*resource, error) {
+			return &resource{name: key, closeErr: closeErr}, nil
+		}))
+		defer stop()
+
+		_ = cs.GetConnection("queue")
+		cs.OnNewRemoteConnection("db", &resource{name: "db"})
+
+		err := cs.Shutdown(context.Background())
+		var shutdownErr *domain.ShutdownError
+		if assert.ErrorAs(t, err, &shutdownErr) {
+			assert.Equal(t, map[interface{}]error{"queue": closeErr}, shutdownErr.Failed)
+			assert.Nil(t, shutdownErr.Err)
+		}
+	})
+}
+
+// openedDialer dials fake connections which are open at once
+func openedDialer() domain.ConnectionDialer {
+	return openedDialerWith(nil)
+}
+
+// openedDialerAfter same as openedDialer but every dial takes delay
+func openedDialerAfter(delay time.Duration) domain.ConnectionDialer {
+	return openedDialerWith(func(ctx context.Context, peer domain.PeerID) error {
+		<-time.After(delay)
+		return nil
+	})
+}
+
+// openedDialerWith same as openedDialer but calls before ahead of every dial, its error fails the dial
+func openedDialerWith(before func(ctx context.Context, peer domain.PeerID) error) domain.ConnectionDialer {
+	return domain.ConnectionDialerFunc(func(ctx context.Context, peer domain.PeerID) (domain.Connection, error) {
+		if before != nil {
+			if err := before(ctx, peer); err != nil {
+				return nil, err
+			}
+		}
+		return aggregate.NewFakeConnectionOpened(peer), nil
+	})
+}
+
+// shutdownNoWait stops storage without waiting for connections to close, fake ones are closed slowly
+func shutdownNoWait(storage domain.ConnectionsStorage) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = storage.Shutdown(ctx)
+	<-storage.Done()
+}
+
 func NewBenchmarkGetConnection(b *testing.B, createFn InitStorageFn) {
-	const ip = 123
+	ip := domain.PeerFromInt32(123)
 
 	wrongConnCounter := uint64(0)
 
@@ -240,7 +1434,7 @@ func NewBenchmarkGetConnection(b *testing.B, createFn InitStorageFn) {
 			}()
 
 			<-start
-			remoteConn = aggregate.NewConnection(ip)
+			remoteConn = aggregate.NewFakeConnectionOpened(ip)
 			cs.OnNewRemoteConnection(ip, remoteConn)
 
 			<-done
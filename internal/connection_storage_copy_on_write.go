@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// NewConnectionStorageCopyOnWrite create storage with initial size of cache
+func NewConnectionStorageCopyOnWrite(initSize int, opts ...StorageOption) *connectionStorageCopyOnWrite[domain.PeerID, domain.Connection] {
+	options := newStorageOptions(opts)
+
+	return NewStorageCopyOnWrite(initSize, options.dialer, opts...)
+}
+
+// NewStorageCopyOnWrite create storage which finds cached connection without lock.
+// Every change of cache publishes its copy, so it suits workload where GetConnection mostly hits cache
+func NewStorageCopyOnWrite[K comparable, C domain.Connection](
+	initSize int, dialer domain.Dialer[K, C], opts ...StorageOption,
+) *connectionStorageCopyOnWrite[K, C] {
+	options := newStorageOptions(opts)
+
+	base := newStorageOnMutex(initSize, options, newStorageDeps(dialer, options), nil)
+	base.index = newCowIndex[K, C]()
+
+	return &connectionStorageCopyOnWrite[K, C]{connectionStorageOnMutex: base}
+}
+
+var _ domain.ConnectionsStorage = &connectionStorageCopyOnWrite[domain.PeerID, domain.Connection]{}
+
+// connectionStorageCopyOnWrite reads cache copy on hit,
+// misses, dials, waiting and maintenance are done by mutex storage under lock
+type connectionStorageCopyOnWrite[K comparable, C domain.Connection] struct {
+	*connectionStorageOnMutex[K, C]
+}
+
+// GetConnection returns zero C if connection can't be established
+func (c *connectionStorageCopyOnWrite[K, C]) GetConnection(peer K) C {
+	conn, _ := c.GetConnectionContext(context.Background(), peer)
+	return conn
+}
+
+// GetConnectionContext returns live cached connection without lock,
+// dead, expired or missing one is repaired or dialed under lock
+func (c *connectionStorageCopyOnWrite[K, C]) GetConnectionContext(ctx context.Context, peer K) (C, error) {
+	if entry, ok := c.hit(ctx, peer); ok {
+		return entry.conn, nil
+	}
+	return c.connectionStorageOnMutex.GetConnectionContext(ctx, peer)
+}
+
+// GetConnections finds cached peers in cache copy without lock and gets missing ones in parallel
+func (c *connectionStorageCopyOnWrite[K, C]) GetConnections(ctx context.Context, peers []K) map[K]domain.ConnectionResult[C] {
+	return getBatch(ctx, peers, c.probe, c.hits, c.GetConnectionContext)
+}
+
+// Acquire same as GetConnectionContext but borrows connection,
+// replaced or evicted connection is not closed until all its leases are released
+func (c *connectionStorageCopyOnWrite[K, C]) Acquire(ctx context.Context, peer K) (domain.Lease[C], error) {
+	if entry, ok := c.hit(ctx, peer); ok {
+		if l, leased := c.leases.acquire(peer, entry, time.Now()); leased {
+			return l, nil
+		}
+		// entry was retired after copy was loaded
+	}
+	return c.connectionStorageOnMutex.Acquire(ctx, peer)
+}
+
+// Peek returns cached open connection without dialing, lock and marking it used
+func (c *connectionStorageCopyOnWrite[K, C]) Peek(peer K) (C, bool) {
+	if entry, found := c.index.load()[peer]; found && entry.conn.State() == domain.StateOpen {
+		return entry.conn, true
+	}
+	var zero C
+	return zero, false
+}
+
+// Len returns count of cached connections
+func (c *connectionStorageCopyOnWrite[K, C]) Len() int {
+	return len(c.index.load())
+}
+
+// hit finds live connection in cache copy and marks it used
+func (c *connectionStorageCopyOnWrite[K, C]) hit(ctx context.Context, peer K) (*cacheEntry[C], bool) {
+	if c.life.isClosing() {
+		return nil, false
+	}
+	entry, found := c.index.load()[peer]
+	if !found {
+		return nil, false
+	}
+
+	now := time.Now()
+	if !entry.alive(c.expiry, now) || c.probe.check(ctx, entry.conn) != nil {
+		return nil, false
+	}
+	entry.use(now)
+	return entry, true
+}
+
+// hits returns alive connections of peers from cache copy and marks them used
+func (c *connectionStorageCopyOnWrite[K, C]) hits(peers []K) map[K]C {
+	if c.life.isClosing() {
+		return nil
+	}
+	now := time.Now()
+	index := c.index.load()
+
+	conns := make(map[K]C, len(peers))
+	for _, peer := range peers {
+		if entry, found := index[peer]; found && entry.alive(c.expiry, now) {
+			entry.use(now)
+			conns[peer] = entry.conn
+		}
+	}
+	return conns
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+func TestConnectionStorageCopyOnWrite_GetConnection(t *testing.T) {
+	const size = 1024
+
+	NewTestSuite(t, func(opts ...StorageOption) (storage domain.ConnectionsStorage, cancelFn func()) {
+		storage = NewConnectionStorageCopyOnWrite(size, opts...)
+		go storage.Run()
+		return storage, func() {
+			_ = storage.Shutdown(context.Background())
+		}
+	})
+}
+
+func TestConnectionStorageCopyOnWrite_Generic(t *testing.T) {
+	const size = 16
+
+	NewGenericTestSuite(t, func(dialer domain.Dialer[string, *resource]) (storage domain.Storage[string, *resource], cancelFn func()) {
+		storage = NewStorageCopyOnWrite(size, dialer)
+		go storage.Run()
+		return storage, func() {
+			_ = storage.Shutdown(context.Background())
+		}
+	})
+}
+
+// BenchmarkConnectionStorageCopyOnWrite_GetConnection checks efficiency open connection callback running
+//
+// go test -gcflags=-N -test.bench '^\QBenchmarkConnectionStorageCopyOnWrite_GetConnection\E$' -run ^$ -benchmem -test.benchtime 10000x ./...
+func BenchmarkConnectionStorageCopyOnWrite_GetConnection(b *testing.B) {
+	const size = 1024
+
+	NewBenchmarkGetConnection(b, func(opts ...StorageOption) (storage domain.ConnectionsStorage, cancelFn func()) {
+		storage = NewConnectionStorageCopyOnWrite(size, opts...)
+		go storage.Run()
+		return storage, func() {
+			shutdownNoWait(storage)
+		}
+	})
+}
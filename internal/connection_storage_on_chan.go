@@ -2,9 +2,9 @@ package internal
 
 import (
 	"context"
-	"fmt"
+	"sync/atomic"
+	"time"
 
-	"github.com/goforbroke1006/unknown-livecoding-1/aggregate"
 	"github.com/goforbroke1006/unknown-livecoding-1/domain"
 	"github.com/goforbroke1006/unknown-livecoding-1/pkg"
 )
@@ -12,165 +12,590 @@ import (
 type operationKind string
 
 const (
-	operationKindRead  = operationKind("read")
-	operationKindWrite = operationKind("write")
+	operationKindRead       = operationKind("read")
+	operationKindWrite      = operationKind("write")
+	operationKindFail       = operationKind("fail")
+	operationKindDrop       = operationKind("drop")
+	operationKindRestore    = operationKind("restore")
+	operationKindInspect    = operationKind("inspect")
+	operationKindPeek       = operationKind("peek")
+	operationKindRange      = operationKind("range")
+	operationKindLen        = operationKind("len")
+	operationKindDisconnect = operationKind("disconnect")
+	operationKindLease      = operationKind("lease")
+	operationKindBatch      = operationKind("batch")
 )
 
-type operation struct {
-	kind operationKind
-	addr int32
-	conn domain.Connection
+type operation[K comparable, C domain.Connection] struct {
+	kind   operationKind
+	addr   K
+	peers  []K // is read by batch operation
+	conn   C
+	origin origin
+	err    error
+	reply  chan connState[K, C] // is used by operations which answer to the caller only
+
+	inspect func(cache map[K]*cacheEntry[C]) // reads cache inside Run loop, must not keep it
+	visit   func(peer K, conn C)             // is called for every cached connection by range operation
 }
 
 // NewConnectionStorage create storage with initial size of cache
-func NewConnectionStorageOnChan(initSize int) *connectionStorageOnChan {
-	return &connectionStorageOnChan{
-		cache: make(map[int32]domain.Connection, initSize),
+func NewConnectionStorageOnChan(initSize int, opts ...StorageOption) *connectionStorageOnChan[domain.PeerID, domain.Connection] {
+	options := newStorageOptions(opts)
 
-		readConnPS:       pkg.NewPubSub(),
-		operations:       make(chan operation, initSize),
-		operationsAnswer: make(chan struct{}),
+	return NewStorageOnChan(initSize, options.dialer, opts...)
+}
 
-		stopInit: make(chan struct{}),
-		stopDone: make(chan struct{}),
+// NewStorageOnChan create storage with initial size of cache for any kind of peer key and connection
+func NewStorageOnChan[K comparable, C domain.Connection](
+	initSize int, dialer domain.Dialer[K, C], opts ...StorageOption,
+) *connectionStorageOnChan[K, C] {
+	options := newStorageOptions(opts)
+	deps := newStorageDeps(dialer, options)
+
+	return &connectionStorageOnChan[K, C]{
+		dialer:    deps.dialer,
+		expiry:    options.expiry,
+		probe:     options.probe,
+		counters:  deps.counters,
+		health:    deps.health,
+		reconnect: deps.reconnect,
+		breaker:   deps.breaker,
+		leases:    deps.leases,
+		dials:     pkg.NewSingleFlight[K, C](),
+
+		entryCache: newEntryCache(initSize, options, deps, nil),
+
+		readConnPS:       pkg.NewPubSub[K, connState[K, C]](),
+		operations:       make(chan operation[K, C], initSize),
+		operationsAnswer: make(chan struct{}),
 	}
 }
 
-type connectionStorageOnChan struct {
-	cache map[int32]domain.Connection
-
-	readConnPS       pkg.PubSub
-	operations       chan operation
+type connectionStorageOnChan[K comparable, C domain.Connection] struct {
+	dialer    domain.Dialer[K, C]
+	expiry    expiryPolicy
+	probe     HealthProbe
+	counters  *counters
+	health    *healthChecker[K, C]
+	reconnect *reconnector[K, C]
+	breaker   *circuitBreaker[K]
+	leases    *leaseRegistry[K, C]
+	dials     pkg.SingleFlight[K, C]
+
+	*entryCache[K, C] // is changed by Run loop only
+
+	readConnPS       pkg.PubSub[K, connState[K, C]]
+	operations       chan operation[K, C]
 	operationsAnswer chan struct{}
-
-	stopInit chan struct{}
-	stopDone chan struct{}
 }
 
-var _ domain.ConnectionsStorage = &connectionStorageOnChan{}
+var _ domain.ConnectionsStorage = &connectionStorageOnChan[domain.PeerID, domain.Connection]{}
 
-// GetConnection try to get connection in 3 parallel ways
-// 1. Expect for new remote connection
-// 2. Expect reading existing connection
-// 3. Await new opened connection (step skips if remote connection from step 1 appears)
-func (c connectionStorageOnChan) GetConnection(ipAddress int32) (result domain.Connection) {
+// GetConnection try to get connection in 3 ways
+// 1. Read existing connection or recent dial error, wait for free slot if storage is full
+// 2. Expect for new remote connection
+// 3. Await new opened connection (step skips if remote connection from step 2 appears)
+func (c connectionStorageOnChan[K, C]) GetConnection(peer K) C {
+	conn, _ := c.GetConnectionContext(context.Background(), peer)
+	return conn
+}
 
-	topic := fmt.Sprintf("%d", ipAddress)
-	const getConnOptions = 3 // get existing, open new, catch from remote
-	notifyConnCh := make(chan interface{}, getConnOptions)
-	c.readConnPS.Subscribe(topic, notifyConnCh)
-	defer c.readConnPS.Unsubscribe(topic, notifyConnCh)
+// GetConnectionContext works like GetConnection but stops waiting when ctx is done.
+// On leave it unsubscribes from peer's topic and aborts own dial, so late opened connection is closed
+func (c connectionStorageOnChan[K, C]) GetConnectionContext(ctx context.Context, peer K) (C, error) {
+	var zero C
+	if c.life.isClosing() {
+		return zero, &domain.GetConnectionError{Peer: peer, Err: domain.ErrStorageClosed}
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	const getConnOptions = 3 // open new, catch from remote, catch failure
+	notifyConnCh := make(chan connState[K, C], getConnOptions)
+	c.readConnPS.Subscribe(peer, notifyConnCh)
+	defer c.readConnPS.Unsubscribe(peer, notifyConnCh)
 
-	go c.reading(ipAddress)
+	for {
+		state := c.reading(peer)
+		if !state.full {
+			if state.found && c.probe.check(ctx, state.conn) != nil {
+				c.dropping(peer, state.conn)
+				atomic.AddUint64(&c.counters.staleRepaired, 1)
+				continue
+			}
+			if state.found || state.err != nil {
+				return state.result()
+			}
+			break
+		}
 
-	go func(ctx context.Context) { // try open new connection
-		newConn := aggregate.NewConnection(ipAddress)
-		newConn.Open()
+		if c.capacity.mode != FullBlock {
+			return zero, &domain.GetConnectionError{Peer: peer, Err: domain.ErrStorageFull}
+		}
 		select {
+		case <-state.slotFreed:
+			// read again, slot can be taken by another caller already
+		case chunk := <-notifyConnCh:
+			return chunk.result()
 		case <-ctx.Done():
-			go func() { newConn.Close() }()
-		default:
-			c.writing(ipAddress, newConn)
+			return zero, &domain.GetConnectionError{Peer: peer, Err: ctx.Err()}
+		case <-c.life.closing:
+			return zero, &domain.GetConnectionError{Peer: peer, Err: domain.ErrStorageClosed}
 		}
-	}(ctx)
+	}
+
+	// dial is aborted when caller leaves because of own ctx or Shutdown only.
+	// Remote connection arrived meanwhile aborts it too, unless tie-break policy has to choose between them
+	dialCtx, abortDial := context.WithCancel(context.Background())
+	go func() { // try open new connection, concurrent callers share one dial
+		defer abortDial()
+		_, _, _ = c.dials.Do(dialCtx, peer, c.dialing)
+	}()
 
 	// wait for connection
 	select {
 	case chunk := <-notifyConnCh:
-		cancel()
-		result = chunk.(connState).conn
-		break
+		if c.tieBreak == nil {
+			abortDial()
+		}
+		return chunk.result()
+	case <-ctx.Done():
+		abortDial()
+		return zero, &domain.GetConnectionError{Peer: peer, Err: ctx.Err()}
+	case <-c.life.closing:
+		abortDial()
+		return zero, &domain.GetConnectionError{Peer: peer, Err: domain.ErrStorageClosed}
 	}
+}
 
-	return result
+// GetConnections reads all cached peers by single operation and gets missing ones in parallel
+func (c connectionStorageOnChan[K, C]) GetConnections(ctx context.Context, peers []K) map[K]domain.ConnectionResult[C] {
+	return getBatch(ctx, peers, c.probe, c.batching, c.GetConnectionContext)
+}
+
+// Acquire same as GetConnectionContext but borrows connection,
+// replaced or evicted connection is not closed until all its leases are released
+func (c connectionStorageOnChan[K, C]) Acquire(ctx context.Context, peer K) (domain.Lease[C], error) {
+	for {
+		conn, err := c.GetConnectionContext(ctx, peer)
+		if err != nil {
+			return nil, err
+		}
+
+		state := c.asking(operation[K, C]{kind: operationKindLease, addr: peer, conn: conn})
+		if state.err != nil {
+			return nil, &domain.GetConnectionError{Peer: peer, Err: state.err}
+		}
+		if state.found {
+			return state.lease, nil
+		}
+		// connection was replaced or evicted meanwhile, borrow actual one
+	}
+}
+
+// LeakedLeases returns leases held longer than WithLeaseLeakThreshold
+func (c connectionStorageOnChan[K, C]) LeakedLeases() []LeaseInfo[K] {
+	return c.leases.leaked(time.Now())
 }
 
 // OnNewRemoteConnection store new connection from remote peer
-func (c connectionStorageOnChan) OnNewRemoteConnection(remotePeer int32, conn domain.Connection) {
-	c.writing(remotePeer, conn)
+func (c connectionStorageOnChan[K, C]) OnNewRemoteConnection(remotePeer K, conn C) {
+	if conn.State() != domain.StateOpen { // GetConnection would evict it as stale, waiters should not get it either
+		go func() { _ = conn.Close() }()
+		return
+	}
+	if !c.writing(remotePeer, conn, inbound) { // storage is shut down, Shutdown does not wait for foreign connection
+		go func() { _ = conn.Close() }()
+	}
 }
 
 // Run process next type of operations
 // * stopping storage pipelines and clear it
 // * reading from cache
 // * writing to cache
-func (c *connectionStorageOnChan) Run() {
+// * remembering dial failures
+// * reaping expired connections
+// * starting background health checks
+func (c *connectionStorageOnChan[K, C]) Run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ticks := newMaintenanceTicks(c.expiry, c.health.interval)
+	defer ticks.stop()
+
 RunLoop:
 	for {
 		select {
-		case <-c.stopInit:
+		case <-c.life.closing:
 			break RunLoop
 		case chunk := <-c.operations:
 			c.processOperation(chunk)
+		case now := <-ticks.reap:
+			c.reapExpired(now)
+		case <-ticks.health:
+			go c.checkHealth(ctx, c.connections())
 		}
 	}
+	cancel() // stop health checks and redials
 
 	c.closeAllConnections()
 
-	c.stopDone <- struct{}{}
+	c.life.stop()
 }
 
-func (c *connectionStorageOnChan) processOperation(chunk operation) {
-	topic := fmt.Sprintf("%d", chunk.addr)
-	var connection domain.Connection
+func (c *connectionStorageOnChan[K, C]) processOperation(chunk operation[K, C]) {
+	state := connState[K, C]{ip: chunk.addr}
+	now := time.Now()
 
 	switch chunk.kind {
 	case operationKindWrite:
-		if old, found := c.cache[chunk.addr]; found {
-			go func() { old.Close() }()
+		if entry, stored := c.store(chunk.addr, chunk.conn, chunk.origin, now); stored {
+			state.conn, state.found = entry.conn, true
+		} else {
+			c.closer.close(chunk.addr, chunk.conn)
+			state.err = domain.ErrStorageFull
 		}
-		c.cache[chunk.addr] = chunk.conn
-		connection = chunk.conn
+
+	case operationKindFail:
+		if rememberDialFailure(chunk.err) {
+			c.failures.remember(chunk.addr, chunk.err, now)
+		}
+		state.err = chunk.err
+
+	case operationKindDrop:
+		if entry, found := c.cache[chunk.addr]; found && sameConn(entry.conn, chunk.conn) {
+			c.evict(chunk.addr, entry)
+		}
+
+	case operationKindRestore:
+		if _, found := c.cache[chunk.addr]; found {
+			c.closer.close(chunk.addr, chunk.conn)
+		} else if entry, stored := c.store(chunk.addr, chunk.conn, chunk.origin, now); stored {
+			state.conn, state.found = entry.conn, true
+		} else {
+			c.closer.close(chunk.addr, chunk.conn)
+		}
+
+	case operationKindInspect:
+		chunk.inspect(c.cache)
+
+	case operationKindPeek:
+		if entry, found := c.cache[chunk.addr]; found && entry.conn.State() == domain.StateOpen {
+			state.conn, state.found = entry.conn, true
+		}
+		chunk.reply <- state
+
+	case operationKindRange:
+		for ip, entry := range c.cache {
+			chunk.visit(ip, entry.conn)
+		}
+
+	case operationKindLen:
+		state.size = len(c.cache)
+		chunk.reply <- state
+
+	case operationKindLease:
+		if entry, found := c.cache[chunk.addr]; found && sameConn(entry.conn, chunk.conn) {
+			state.lease, state.found = c.leases.acquire(chunk.addr, entry, now)
+		}
+		chunk.reply <- state
+
+	case operationKindBatch:
+		state.batch = make(map[K]C, len(chunk.peers))
+		for _, ip := range chunk.peers {
+			if entry, found := c.cache[ip]; found && entry.alive(c.expiry, now) { // others are repaired by GetConnection
+				entry.use(now)
+				state.batch[ip] = entry.conn
+			}
+		}
+		chunk.reply <- state
+
+	case operationKindDisconnect:
+		if entry, found := c.cache[chunk.addr]; found {
+			c.evict(chunk.addr, entry)
+			state.found = true
+		}
+		chunk.reply <- state
 
 	case operationKindRead:
-		if conn, found := c.cache[chunk.addr]; found {
-			connection = conn
+		entry, found := c.cache[chunk.addr]
+		if found && entry.expired(c.expiry, now) { // reaper has not got it yet
+			c.evict(chunk.addr, entry)
+			found = false
+		}
+		if found && entry.conn.State() != domain.StateOpen { // stale, dial new one instead
+			c.evict(chunk.addr, entry)
+			atomic.AddUint64(&c.counters.staleRepaired, 1)
+			found = false
 		}
-	}
 
-	if connection != nil {
-		state := connState{
-			ip:   chunk.addr,
-			conn: connection,
+		failure, failed := c.failures.recent(chunk.addr, now)
+		switch {
+		case found:
+			entry.use(now)
+			state.conn, state.found = entry.conn, true
+		case failed:
+			state.err = failure
+		case !c.capacity.hasRoom(len(c.cache)) && c.capacity.eviction == nil:
+			state.full, state.slotFreed = true, c.slotFreed
 		}
-		c.readConnPS.Publish(topic, state)
+		chunk.reply <- state
+	}
+
+	if chunk.reply == nil && (state.found || state.err != nil) {
+		c.readConnPS.TryPublish(chunk.addr, state)
 	}
 
 	c.operationsAnswer <- struct{}{}
 }
 
-// Shutdown break loop inside connectionStorage.Run() method and return to the 'owner' goroutine
-func (c connectionStorageOnChan) Shutdown() {
-	c.stopInit <- struct{}{}
-	<-c.stopDone
+// Done is closed when storage is shut down and cached connections are retired
+func (c connectionStorageOnChan[K, C]) Done() <-chan struct{} {
+	return c.life.stopped
 }
 
-// reading func send request for reading
-// You have to subscribe on connectionStorage.readConnPS(fmt.Sprint("%d", ip), yourChannel) to read data
-func (c connectionStorageOnChan) reading(ip int32) {
-	c.operations <- operation{kind: operationKindRead, addr: ip}
-	<-c.operationsAnswer
+// Shutdown rejects new callers, breaks loop inside connectionStorage.Run() method
+// and waits for cached connections to close until ctx is done
+func (c connectionStorageOnChan[K, C]) Shutdown(ctx context.Context) error {
+	c.closer.drain()
+	c.life.shutdown()
+
+	select {
+	case <-c.life.stopped:
+	case <-ctx.Done(): // Run loop is not started or busy
+		return &domain.ShutdownError{Err: ctx.Err()}
+	}
+	return c.closer.wait(ctx)
 }
 
-// writing func send request for writing connection to cache
-func (c connectionStorageOnChan) writing(ip int32, conn domain.Connection) {
-	c.operations <- operation{kind: operationKindWrite, addr: ip, conn: conn}
-	<-c.operationsAnswer
+// sending func send operation to Run loop and waits it is processed,
+// returns false if Run loop is stopped
+func (c connectionStorageOnChan[K, C]) sending(op operation[K, C]) bool {
+	select {
+	case c.operations <- op:
+	case <-c.life.stopped:
+		return false
+	}
+	select {
+	case <-c.operationsAnswer:
+		return true
+	case <-c.life.stopped: // operation is left in buffer
+		return false
+	}
+}
+
+// reading func send request for reading, result is answered to the caller only
+func (c connectionStorageOnChan[K, C]) reading(ip K) connState[K, C] {
+	return c.asking(operation[K, C]{kind: operationKindRead, addr: ip})
+}
+
+// asking func send request which result is answered to the caller only,
+// answer has ErrStorageClosed if Run loop is stopped
+func (c connectionStorageOnChan[K, C]) asking(op operation[K, C]) connState[K, C] {
+	op.reply = make(chan connState[K, C], 1)
+	if !c.sending(op) {
+		return connState[K, C]{ip: op.addr, err: domain.ErrStorageClosed}
+	}
+	return <-op.reply
+}
+
+// batching func send request for reading connections of many peers at once,
+// nothing is found if storage is shut down
+func (c connectionStorageOnChan[K, C]) batching(peers []K) map[K]C {
+	return c.asking(operation[K, C]{kind: operationKindBatch, peers: peers}).batch
+}
+
+// Peek returns cached open connection without dialing and without marking it used
+func (c connectionStorageOnChan[K, C]) Peek(peer K) (C, bool) {
+	state := c.asking(operation[K, C]{kind: operationKindPeek, addr: peer})
+	return state.conn, state.found
+}
+
+// Range calls fn for every cached connection until fn returns false
+func (c connectionStorageOnChan[K, C]) Range(fn func(peer K, conn C) bool) {
+	type peerConn struct {
+		peer K
+		conn C
+	}
+	var conns []peerConn
+	c.sending(operation[K, C]{kind: operationKindRange, visit: func(peer K, conn C) {
+		conns = append(conns, peerConn{peer: peer, conn: conn})
+	}})
+
+	for _, pc := range conns { // out of Run loop, fn may call storage
+		if !fn(pc.peer, pc.conn) {
+			return
+		}
+	}
+}
+
+// Len returns count of cached connections
+func (c connectionStorageOnChan[K, C]) Len() int {
+	return c.asking(operation[K, C]{kind: operationKindLen}).size
+}
+
+// Disconnect closes and removes peer's connection, next GetConnection dials it again
+func (c connectionStorageOnChan[K, C]) Disconnect(peer K) bool {
+	return c.asking(operation[K, C]{kind: operationKindDisconnect, addr: peer}).found
+}
+
+// writing func send request for writing connection to cache,
+// returns false if storage is shut down and connection is not taken
+func (c connectionStorageOnChan[K, C]) writing(ip K, conn C, origin origin) bool {
+	return c.sending(operation[K, C]{kind: operationKindWrite, addr: ip, conn: conn, origin: origin})
+}
+
+// failing func send dial error to every waiter of ip and remember it for a while
+func (c connectionStorageOnChan[K, C]) failing(ip K, err error) {
+	c.sending(operation[K, C]{kind: operationKindFail, addr: ip, err: err})
+}
+
+// dialing opens new connection and writes it to cache or reports failure to waiters.
+// ctx is done when all callers waiting for the dial left
+func (c connectionStorageOnChan[K, C]) dialing(ctx context.Context, peer K) (C, error) {
+	c.events.emit(domain.EventDialing, peer, domain.Outbound, nil)
+	start := time.Now()
+	newConn, err := c.reconnect.dial(ctx, peer, c.dialer)
+	if err != nil {
+		if ctx.Err() == nil { // dial was not aborted by callers
+			c.events.emit(domain.EventDialFailed, peer, domain.Outbound, err)
+			c.failing(peer, err)
+		}
+		return newConn, err
+	}
+	var zero C
+	select {
+	case <-ctx.Done():
+		c.closer.close(peer, newConn)
+		return zero, ctx.Err()
+	default:
+	}
+	if !c.writing(peer, newConn, dialed(time.Since(start))) {
+		c.closer.close(peer, newConn)
+		return zero, domain.ErrStorageClosed
+	}
+	return newConn, nil
+}
+
+// restoring func send request for writing connection redialed by health checker,
+// it is closed if peer has got another connection meanwhile
+func (c connectionStorageOnChan[K, C]) restoring(ip K, conn C, dialDuration time.Duration) {
+	if !c.sending(operation[K, C]{kind: operationKindRestore, addr: ip, conn: conn, origin: dialed(dialDuration)}) {
+		c.closer.close(ip, conn)
+	}
+}
+
+// dropping func send request for removing connection which failed health probe,
+// connection is kept if it was replaced already
+func (c connectionStorageOnChan[K, C]) dropping(ip K, conn C) {
+	c.sending(operation[K, C]{kind: operationKindDrop, addr: ip, conn: conn})
+}
+
+// Stats returns counters of storage work
+func (c connectionStorageOnChan[K, C]) Stats() Stats {
+	return c.counters.snapshot()
+}
+
+// Watch streams lifecycle events of cached connections matching filter until ctx is done.
+// Events are buffered by WithWatchBuffer, newer ones are dropped while buffer is full
+func (c connectionStorageOnChan[K, C]) Watch(ctx context.Context, filter WatchFilter[K]) <-chan domain.Event[K] {
+	return c.events.watch(ctx, filter)
+}
+
+// Describe returns metadata of peer's cached connection
+func (c connectionStorageOnChan[K, C]) Describe(peer K) (domain.ConnectionInfo[K], bool) {
+	var (
+		info  domain.ConnectionInfo[K]
+		found bool
+	)
+	c.inspecting(func(cache map[K]*cacheEntry[C]) {
+		var entry *cacheEntry[C]
+		if entry, found = cache[peer]; found {
+			info = describe(peer, entry)
+		}
+	})
+	return info, found
+}
+
+// Snapshot returns metadata of all cached connections
+func (c connectionStorageOnChan[K, C]) Snapshot() []domain.ConnectionInfo[K] {
+	var infos []domain.ConnectionInfo[K]
+	c.inspecting(func(cache map[K]*cacheEntry[C]) {
+		infos = make([]domain.ConnectionInfo[K], 0, len(cache))
+		for ip, entry := range cache {
+			infos = append(infos, describe(ip, entry))
+		}
+	})
+	return infos
+}
+
+// inspecting func send request for reading cache with fn inside Run loop
+func (c connectionStorageOnChan[K, C]) inspecting(fn func(cache map[K]*cacheEntry[C])) {
+	c.sending(operation[K, C]{kind: operationKindInspect, inspect: fn})
+}
+
+// CircuitState returns state of circuit breaker around dials to peer
+func (c connectionStorageOnChan[K, C]) CircuitState(peer K) BreakerState {
+	return c.breaker.state(peer, time.Now())
+}
+
+// HealthOf returns result of last background health check of peer
+func (c connectionStorageOnChan[K, C]) HealthOf(peer K) (ProbeResult, bool) {
+	return c.health.result(peer)
+}
+
+// checkHealth probes connections out of Run loop, failed ones are dropped and redialed
+func (c connectionStorageOnChan[K, C]) checkHealth(ctx context.Context, conns map[K]C) {
+	for peer, conn := range c.health.run(ctx, conns) {
+		c.dropping(peer, conn)
+		go c.health.redial(ctx, peer, c.dialer, c.restoring)
+	}
+}
+
+// connections copy cache for work out of Run loop
+func (c *connectionStorageOnChan[K, C]) connections() map[K]C {
+	conns := make(map[K]C, len(c.cache))
+	for ip, entry := range c.cache {
+		conns[ip] = entry.conn
+	}
+	return conns
+}
+
+// reapExpired close idle and too old connections, next GetConnection dials them again
+func (c *connectionStorageOnChan[K, C]) reapExpired(now time.Time) {
+	for ip, entry := range c.cache {
+		if entry.expired(c.expiry, now) {
+			c.evict(ip, entry)
+		}
+	}
 }
 
 // closeAllConnections delete all keeping connection.
 // Should be run after connectionStorage.Run loop break to prevent race on connectionStorage.cache
-func (c connectionStorageOnChan) closeAllConnections() {
-	for ip, conn := range c.cache {
-		go func() { conn.Close() }()
-		delete(c.cache, ip)
+func (c connectionStorageOnChan[K, C]) closeAllConnections() {
+	for ip, entry := range c.cache {
+		c.evict(ip, entry)
 	}
 }
 
 // connState transport data about connection's changes
-type connState struct {
-	ip   int32
-	conn domain.Connection
+type connState[K comparable, C domain.Connection] struct {
+	ip    K
+	conn  C
+	found bool
+	err   error
+
+	full      bool // no room for new connection, wait for slotFreed
+	slotFreed <-chan struct{}
+
+	size  int          // is answered by len operation
+	lease *lease[K, C] // is answered by lease operation
+	batch map[K]C      // is answered by batch operation
+}
+
+func (s connState[K, C]) result() (C, error) {
+	if s.err != nil {
+		var zero C
+		return zero, &domain.GetConnectionError{Peer: s.ip, Err: s.err}
+	}
+	return s.conn, nil
 }
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"testing"
 
 	"github.com/goforbroke1006/unknown-livecoding-1/aggregate"
@@ -10,11 +11,23 @@ import (
 func TestConnectionStorageOnChan_GetConnection(t *testing.T) {
 	const size = 1024
 
-	NewTestSuite(t, func() (storage domain.ConnectionsStorage, cancelFn func()) {
-		storage = NewConnectionStorageOnChan(size)
+	NewTestSuite(t, func(opts ...StorageOption) (storage domain.ConnectionsStorage, cancelFn func()) {
+		storage = NewConnectionStorageOnChan(size, opts...)
 		go storage.Run()
 		return storage, func() {
-			storage.Shutdown()
+			_ = storage.Shutdown(context.Background())
+		}
+	})
+}
+
+func TestConnectionStorageOnChan_Generic(t *testing.T) {
+	const size = 16
+
+	NewGenericTestSuite(t, func(dialer domain.Dialer[string, *resource]) (storage domain.Storage[string, *resource], cancelFn func()) {
+		storage = NewStorageOnChan(size, dialer)
+		go storage.Run()
+		return storage, func() {
+			_ = storage.Shutdown(context.Background())
 		}
 	})
 }
@@ -38,11 +51,11 @@ func TestConnectionStorageOnChan_GetConnection(t *testing.T) {
 func BenchmarkConnectionStorageOnChan_GetConnection(b *testing.B) {
 	const size = 1024
 
-	NewBenchmarkGetConnection(b, func() (storage domain.ConnectionsStorage, cancelFn func()) {
-		storage = NewConnectionStorageOnChan(size)
+	NewBenchmarkGetConnection(b, func(opts ...StorageOption) (storage domain.ConnectionsStorage, cancelFn func()) {
+		storage = NewConnectionStorageOnChan(size, opts...)
 		go storage.Run()
 		return storage, func() {
-			storage.Shutdown()
+			shutdownNoWait(storage)
 		}
 	})
 }
@@ -57,11 +70,12 @@ func BenchmarkConnectionStorageOnChan_Shutdown(b *testing.B) {
 		go cs.Run()
 
 		b.StopTimer()
-		for peer := startPeer; peer < startPeer+size; peer++ {
-			cs.OnNewRemoteConnection(peer, aggregate.NewConnection(peer))
+		for ip := startPeer; ip < startPeer+size; ip++ {
+			peer := domain.PeerFromInt32(ip)
+			cs.OnNewRemoteConnection(peer, aggregate.NewFakeConnectionOpened(peer))
 		}
 		b.StartTimer()
 
-		cs.Shutdown()
+		shutdownNoWait(cs)
 	}
 }
@@ -2,148 +2,546 @@ package internal
 
 import (
 	"context"
-	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/goforbroke1006/unknown-livecoding-1/aggregate"
 	"github.com/goforbroke1006/unknown-livecoding-1/domain"
 	"github.com/goforbroke1006/unknown-livecoding-1/pkg"
 )
 
-func NewConnectionStorageOnMutex(initSize int) *connectionStorageOnMutex {
-	return &connectionStorageOnMutex{
-		cache:        make(map[int32]domain.Connection, initSize),
-		remoteConnPS: pkg.NewPubSub(),
-		stopInit:     make(chan struct{}),
-		stopDone:     make(chan struct{}),
+func NewConnectionStorageOnMutex(initSize int, opts ...StorageOption) *connectionStorageOnMutex[domain.PeerID, domain.Connection] {
+	options := newStorageOptions(opts)
+
+	return NewStorageOnMutex(initSize, options.dialer, opts...)
+}
+
+// NewStorageOnMutex create storage with initial size of cache for any kind of peer key and connection
+func NewStorageOnMutex[K comparable, C domain.Connection](
+	initSize int, dialer domain.Dialer[K, C], opts ...StorageOption,
+) *connectionStorageOnMutex[K, C] {
+	options := newStorageOptions(opts)
+
+	return newStorageOnMutex(initSize, options, newStorageDeps(dialer, options), nil)
+}
+
+// newStorageOnMutex create storage on deps which may be shared with other storages,
+// slots limits connections of all storages sharing it, it is nil for standalone storage
+func newStorageOnMutex[K comparable, C domain.Connection](
+	initSize int, options storageOptions, deps storageDeps[K, C], slots *slotPool,
+) *connectionStorageOnMutex[K, C] {
+	c := &connectionStorageOnMutex[K, C]{
+		dialer:       deps.dialer,
+		expiry:       options.expiry,
+		probe:        options.probe,
+		counters:     deps.counters,
+		health:       deps.health,
+		reconnect:    deps.reconnect,
+		breaker:      deps.breaker,
+		leases:       deps.leases,
+		dials:        pkg.NewSingleFlight[K, C](),
+		entryCache:   newEntryCache(initSize, options, deps, slots),
+		remoteConnPS: pkg.NewPubSub[K, remoteConnChunk[K, C]](),
 	}
+	c.maintenanceCtx, c.maintenanceStop = context.WithCancel(context.Background())
+	return c
 }
 
-var _ domain.ConnectionsStorage = &connectionStorageOnMutex{}
+var _ domain.ConnectionsStorage = &connectionStorageOnMutex[domain.PeerID, domain.Connection]{}
+
+type connectionStorageOnMutex[K comparable, C domain.Connection] struct {
+	dialer    domain.Dialer[K, C]
+	expiry    expiryPolicy
+	probe     HealthProbe
+	counters  *counters
+	health    *healthChecker[K, C]
+	reconnect *reconnector[K, C]
+	breaker   *circuitBreaker[K]
+	leases    *leaseRegistry[K, C]
+	dials     pkg.SingleFlight[K, C]
 
-type connectionStorageOnMutex struct {
-	cache   map[int32]domain.Connection
-	cacheMx sync.RWMutex
+	*entryCache[K, C] // is guarded by cacheMx
+	cacheMx           sync.RWMutex
 
-	remoteConnPS pkg.PubSub
+	remoteConnPS pkg.PubSub[K, remoteConnChunk[K, C]]
 
-	stopInit chan struct{}
-	stopDone chan struct{}
+	maintenanceCtx  context.Context // is cancelled on Shutdown, stops health checks and redials
+	maintenanceStop context.CancelFunc
 }
 
-func (c *connectionStorageOnMutex) Run() {
-	// do not implement me
+// Run does background maintenance until Shutdown, cache is guarded by mutex and works without it
+// * reaping expired connections
+// * starting background health checks
+func (c *connectionStorageOnMutex[K, C]) Run() {
+	ticks := newMaintenanceTicks(c.expiry, c.health.interval)
+	defer ticks.stop()
+
+	ticks.maintain(c.life.closing, c.reapExpired, func() {
+		c.checkHealth(c.maintenanceCtx, c.connections())
+	})
+
+	<-c.life.stopped // Shutdown closes connections
 }
 
-func (c *connectionStorageOnMutex) GetConnection(ipAddress int32) (result domain.Connection) {
+// Done is closed when storage is shut down and cached connections are retired
+func (c *connectionStorageOnMutex[K, C]) Done() <-chan struct{} {
+	return c.life.stopped
+}
 
-	topic := fmt.Sprintf("%d", ipAddress)
-	notifyConnCh := make(chan interface{})
-	c.remoteConnPS.Subscribe(topic, notifyConnCh)
-	defer c.remoteConnPS.Unsubscribe(topic, notifyConnCh)
+// GetConnection returns zero C if connection can't be established
+func (c *connectionStorageOnMutex[K, C]) GetConnection(peer K) C {
+	conn, _ := c.GetConnectionContext(context.Background(), peer)
+	return conn
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
+// GetConnectionContext works like GetConnection but stops waiting when ctx is done.
+// On leave it unsubscribes from peer's topic and aborts own dial, so late opened connection is closed
+func (c *connectionStorageOnMutex[K, C]) GetConnectionContext(ctx context.Context, peer K) (C, error) {
+	var zero C
+	if c.life.isClosing() {
+		return zero, &domain.GetConnectionError{Peer: peer, Err: domain.ErrStorageClosed}
+	}
 
-	go func(ctx context.Context) { // try open new connection
-		newConn := aggregate.NewConnection(ipAddress)
-		newConn.Open()
-		select {
-		case <-ctx.Done():
-			go func() { newConn.Close() }()
-		default:
-			c.remoteConnPS.Publish(topic, remoteConnChunk{
-				remotePeer: ipAddress,
-				conn:       newConn,
-				needUpdate: true,
-			})
+	const getConnOptions = 3 // open new, catch from remote, catch failure
+	notifyConnCh := make(chan remoteConnChunk[K, C], getConnOptions)
+	c.remoteConnPS.Subscribe(peer, notifyConnCh)
+	defer c.remoteConnPS.Unsubscribe(peer, notifyConnCh)
+
+	// subscribed before lookup, so remote connection can't slip between them
+	existentConn, found := c.lookup(peer)
+	if found && c.probe.check(ctx, existentConn) != nil {
+		if c.drop(peer, existentConn) {
+			atomic.AddUint64(&c.counters.staleRepaired, 1)
 		}
-	}(ctx)
+		found = false
+	}
+	if found {
+		return existentConn, nil
+	}
 
-	go func(ctx context.Context) { // try to find existing
-		c.cacheMx.RLock()
-		existentConn, found := c.cache[ipAddress]
-		c.cacheMx.RUnlock()
+	c.cacheMx.RLock()
+	failure, failed := c.failures.recent(peer, time.Now())
+	c.cacheMx.RUnlock()
 
-		if !found {
-			return
-		}
+	if failed {
+		return zero, &domain.GetConnectionError{Peer: peer, Err: failure}
+	}
 
+	for slotFreed := c.waitRoom(); slotFreed != nil; slotFreed = c.waitRoom() {
+		if c.capacity.mode != FullBlock {
+			return zero, &domain.GetConnectionError{Peer: peer, Err: domain.ErrStorageFull}
+		}
 		select {
+		case <-slotFreed:
+			// check again, slot can be taken by another caller already
+		case <-notifyConnCh:
+			if remoteConn, remoteConnFound := c.lookup(peer); remoteConnFound {
+				return remoteConn, nil
+			}
 		case <-ctx.Done():
-			// do nothing
-		default:
-			c.remoteConnPS.Publish(topic, remoteConnChunk{
-				remotePeer: ipAddress,
-				conn:       existentConn,
-				needUpdate: false,
-			})
+			return zero, &domain.GetConnectionError{Peer: peer, Err: ctx.Err()}
+		case <-c.life.closing:
+			return zero, &domain.GetConnectionError{Peer: peer, Err: domain.ErrStorageClosed}
 		}
-	}(ctx)
+	}
+
+	// dial is aborted when caller leaves because of own ctx or Shutdown only.
+	// Remote connection arrived meanwhile aborts it too, unless tie-break policy has to choose between them
+	dialCtx, abortDial := context.WithCancel(context.Background())
+	go func() { // try open new connection, concurrent callers share one dial
+		defer abortDial()
+		_, _, _ = c.dials.Do(dialCtx, peer, c.dial)
+	}()
 
 	// wait for connection
 	select {
-	case chunk := <-notifyConnCh:
-		cancel()
-
+	case msg := <-notifyConnCh:
+		if c.tieBreak == nil {
+			abortDial()
+		}
+		if msg.err == nil { // connection is stored before notification
+			return msg.conn, nil
+		}
 		// check remote connection exists but was not notified because has no subscribers in right time
-		// or another subscription had updated cache already
+		if remoteConn, remoteConnFound := c.lookup(peer); remoteConnFound {
+			return remoteConn, nil
+		}
+		return zero, &domain.GetConnectionError{Peer: peer, Err: msg.err}
+
+	case <-ctx.Done():
+		abortDial()
+		return zero, &domain.GetConnectionError{Peer: peer, Err: ctx.Err()}
+	case <-c.life.closing:
+		abortDial()
+		return zero, &domain.GetConnectionError{Peer: peer, Err: domain.ErrStorageClosed}
+	}
+}
+
+// GetConnections reads all cached peers under single lock and gets missing ones in parallel
+func (c *connectionStorageOnMutex[K, C]) GetConnections(ctx context.Context, peers []K) map[K]domain.ConnectionResult[C] {
+	return getBatch(ctx, peers, c.probe, c.hits, c.GetConnectionContext)
+}
+
+// Acquire same as GetConnectionContext but borrows connection,
+// replaced or evicted connection is not closed until all its leases are released
+func (c *connectionStorageOnMutex[K, C]) Acquire(ctx context.Context, peer K) (domain.Lease[C], error) {
+	for {
+		conn, err := c.GetConnectionContext(ctx, peer)
+		if err != nil {
+			return nil, err
+		}
+
 		c.cacheMx.RLock()
-		remoteConn, remoteConnFound := c.cache[ipAddress]
+		entry, found := c.cache[peer]
+		var (
+			l      *lease[K, C]
+			leased bool
+		)
+		if found && sameConn(entry.conn, conn) {
+			l, leased = c.leases.acquire(peer, entry, time.Now())
+		}
 		c.cacheMx.RUnlock()
 
-		if remoteConnFound {
-			result = remoteConn
-		} else {
-			result = chunk.(remoteConnChunk).conn
+		if leased {
+			return l, nil
+		}
+		// connection was replaced or evicted meanwhile, borrow actual one
+	}
+}
 
-			if chunk.(remoteConnChunk).needUpdate {
-				c.cacheMx.Lock()
-				c.cache[ipAddress] = chunk.(remoteConnChunk).conn
-				c.cacheMx.Unlock()
-			}
+// LeakedLeases returns leases held longer than WithLeaseLeakThreshold
+func (c *connectionStorageOnMutex[K, C]) LeakedLeases() []LeaseInfo[K] {
+	return c.leases.leaked(time.Now())
+}
+
+// dial opens new connection, stores it and notifies waiters about connection or failure.
+// ctx is done when all callers waiting for the dial left
+func (c *connectionStorageOnMutex[K, C]) dial(ctx context.Context, peer K) (C, error) {
+	var zero C
+
+	c.events.emit(domain.EventDialing, peer, domain.Outbound, nil)
+	start := time.Now()
+	newConn, err := c.reconnect.dial(ctx, peer, c.dialer)
+	if err != nil {
+		if ctx.Err() != nil { // dial was aborted by callers
+			return zero, err
+		}
+		c.events.emit(domain.EventDialFailed, peer, domain.Outbound, err)
+		if rememberDialFailure(err) {
+			c.cacheMx.Lock()
+			c.failures.remember(peer, err, time.Now())
+			c.cacheMx.Unlock()
 		}
 
-		break
+		c.remoteConnPS.TryPublish(peer, remoteConnChunk[K, C]{
+			remotePeer: peer,
+			err:        err,
+		})
+		return zero, err
 	}
+	select {
+	case <-ctx.Done():
+		c.closer.close(peer, newConn)
+		return zero, ctx.Err()
+	default:
+	}
+
+	c.cacheMx.Lock()
+	entry, stored := c.store(peer, newConn, dialed(time.Since(start)), time.Now())
+	c.cacheMx.Unlock()
 
-	return result
+	if !stored {
+		c.closer.close(peer, newConn)
+		err = domain.ErrStorageFull
+		if c.life.isClosing() {
+			err = domain.ErrStorageClosed
+		}
+		c.remoteConnPS.TryPublish(peer, remoteConnChunk[K, C]{
+			remotePeer: peer,
+			err:        err,
+		})
+		return zero, err
+	}
+
+	c.remoteConnPS.TryPublish(peer, remoteConnChunk[K, C]{
+		remotePeer: peer,
+		conn:       entry.conn,
+	})
+	return entry.conn, nil
 }
 
-func (c *connectionStorageOnMutex) OnNewRemoteConnection(remotePeer int32, conn domain.Connection) {
-	topic := fmt.Sprintf("%d", remotePeer)
-	if published := c.remoteConnPS.Publish(topic, remoteConnChunk{
+// OnNewRemoteConnection store new connection from remote peer
+func (c *connectionStorageOnMutex[K, C]) OnNewRemoteConnection(remotePeer K, conn C) {
+	if c.life.isClosing() { // Shutdown does not wait for foreign connection
+		go func() { _ = conn.Close() }()
+		return
+	}
+	if conn.State() != domain.StateOpen { // lookup would evict it as stale, waiters should not get it either
+		go func() { _ = conn.Close() }()
+		return
+	}
+
+	// store before notify, waiters look into cache first, so connection can't be lost
+	// even if some waiter is not ready to receive notification
+	c.cacheMx.Lock()
+	entry, stored := c.store(remotePeer, conn, inbound, time.Now())
+	c.cacheMx.Unlock()
+
+	if !stored {
+		c.closer.close(remotePeer, conn)
+		return
+	}
+
+	c.remoteConnPS.TryPublish(remotePeer, remoteConnChunk[K, C]{
 		remotePeer: remotePeer,
-		conn:       conn,
-		needUpdate: true,
-	}); !published {
+		conn:       entry.conn,
+	})
+}
+
+// Shutdown rejects new callers, stops background work
+// and waits for cached connections to close until ctx is done
+func (c *connectionStorageOnMutex[K, C]) Shutdown(ctx context.Context) error {
+	c.closer.drain()
+	if c.life.shutdown() {
+		c.maintenanceStop()
+		c.closeAllConnections()
+		c.life.stop()
+	}
+
+	select {
+	case <-c.life.stopped:
+	case <-ctx.Done():
+		return &domain.ShutdownError{Err: ctx.Err()}
+	}
+	return c.closer.wait(ctx)
+}
+
+// lookup returns cached connection and marks it used, expired connection is removed instead
+func (c *connectionStorageOnMutex[K, C]) lookup(peer K) (C, bool) {
+	now := time.Now()
+
+	c.cacheMx.RLock()
+	entry, found := c.cache[peer]
+	c.cacheMx.RUnlock()
+
+	if !found {
+		var zero C
+		return zero, false
+	}
+	if entry.expired(c.expiry, now) { // reaper has not got it yet
 		c.cacheMx.Lock()
-		old, found := c.cache[remotePeer]
-		if found {
-			go func() {
-				old.Close()
-			}()
-		}
-		c.cache[remotePeer] = conn
+		c.evict(peer, entry)
 		c.cacheMx.Unlock()
+
+		var zero C
+		return zero, false
 	}
+	if entry.conn.State() != domain.StateOpen { // stale, dial new one instead
+		if c.drop(peer, entry.conn) {
+			atomic.AddUint64(&c.counters.staleRepaired, 1)
+		}
+
+		var zero C
+		return zero, false
+	}
+
+	entry.use(now)
+	return entry.conn, true
+}
+
+// hits returns alive cached connections of peers and marks them used,
+// others are repaired by GetConnection
+func (c *connectionStorageOnMutex[K, C]) hits(peers []K) map[K]C {
+	now := time.Now()
+
+	c.cacheMx.RLock()
+	defer c.cacheMx.RUnlock()
+
+	conns := make(map[K]C, len(peers))
+	for _, peer := range peers {
+		if entry, found := c.cache[peer]; found && entry.alive(c.expiry, now) {
+			entry.use(now)
+			conns[peer] = entry.conn
+		}
+	}
+	return conns
+}
+
+// drop removes dead connection, it is kept if it was replaced already.
+// Returns true if connection was removed
+func (c *connectionStorageOnMutex[K, C]) drop(peer K, conn C) bool {
+	c.cacheMx.Lock()
+	defer c.cacheMx.Unlock()
+
+	if entry, found := c.cache[peer]; found && sameConn(entry.conn, conn) {
+		c.evict(peer, entry)
+		return true
+	}
+	return false
+}
+
+// restore put connection redialed by health checker into cache,
+// it is closed if peer has got another connection meanwhile
+func (c *connectionStorageOnMutex[K, C]) restore(peer K, conn C, dialDuration time.Duration) {
+	c.cacheMx.Lock()
+	_, found := c.cache[peer]
+	stored := false
+	if !found {
+		_, stored = c.store(peer, conn, dialed(dialDuration), time.Now())
+	}
+	c.cacheMx.Unlock()
+
+	if !stored {
+		c.closer.close(peer, conn)
+		return
+	}
+
+	c.remoteConnPS.TryPublish(peer, remoteConnChunk[K, C]{
+		remotePeer: peer,
+		conn:       conn,
+	})
+}
+
+// Peek returns cached open connection without dialing and without marking it used
+func (c *connectionStorageOnMutex[K, C]) Peek(peer K) (C, bool) {
+	c.cacheMx.RLock()
+	defer c.cacheMx.RUnlock()
+
+	if entry, found := c.cache[peer]; found && entry.conn.State() == domain.StateOpen {
+		return entry.conn, true
+	}
+	var zero C
+	return zero, false
+}
+
+// Range calls fn for every cached connection until fn returns false
+func (c *connectionStorageOnMutex[K, C]) Range(fn func(peer K, conn C) bool) {
+	for ip, conn := range c.connections() { // out of lock, fn may call storage
+		if !fn(ip, conn) {
+			return
+		}
+	}
+}
+
+// Len returns count of cached connections
+func (c *connectionStorageOnMutex[K, C]) Len() int {
+	c.cacheMx.RLock()
+	defer c.cacheMx.RUnlock()
+
+	return len(c.cache)
+}
+
+// Disconnect closes and removes peer's connection, next GetConnection dials it again
+func (c *connectionStorageOnMutex[K, C]) Disconnect(peer K) bool {
+	c.cacheMx.Lock()
+	defer c.cacheMx.Unlock()
+
+	entry, found := c.cache[peer]
+	if found {
+		c.evict(peer, entry)
+	}
+	return found
+}
+
+// Stats returns counters of storage work
+func (c *connectionStorageOnMutex[K, C]) Stats() Stats {
+	return c.counters.snapshot()
+}
+
+// Watch streams lifecycle events of cached connections matching filter until ctx is done.
+// Events are buffered by WithWatchBuffer, newer ones are dropped while buffer is full
+func (c *connectionStorageOnMutex[K, C]) Watch(ctx context.Context, filter WatchFilter[K]) <-chan domain.Event[K] {
+	return c.events.watch(ctx, filter)
+}
+
+// Describe returns metadata of peer's cached connection
+func (c *connectionStorageOnMutex[K, C]) Describe(peer K) (domain.ConnectionInfo[K], bool) {
+	c.cacheMx.RLock()
+	defer c.cacheMx.RUnlock()
+
+	entry, found := c.cache[peer]
+	if !found {
+		return domain.ConnectionInfo[K]{}, false
+	}
+	return describe(peer, entry), true
+}
+
+// Snapshot returns metadata of all cached connections
+func (c *connectionStorageOnMutex[K, C]) Snapshot() []domain.ConnectionInfo[K] {
+	c.cacheMx.RLock()
+	defer c.cacheMx.RUnlock()
+
+	infos := make([]domain.ConnectionInfo[K], 0, len(c.cache))
+	for ip, entry := range c.cache {
+		infos = append(infos, describe(ip, entry))
+	}
+	return infos
+}
+
+// CircuitState returns state of circuit breaker around dials to peer
+func (c *connectionStorageOnMutex[K, C]) CircuitState(peer K) BreakerState {
+	return c.breaker.state(peer, time.Now())
 }
 
-func (c *connectionStorageOnMutex) Shutdown() {
-	c.closeAllConnections()
+// HealthOf returns result of last background health check of peer
+func (c *connectionStorageOnMutex[K, C]) HealthOf(peer K) (ProbeResult, bool) {
+	return c.health.result(peer)
+}
+
+// checkHealth probes connections out of lock, failed ones are dropped and redialed
+func (c *connectionStorageOnMutex[K, C]) checkHealth(ctx context.Context, conns map[K]C) {
+	for peer, conn := range c.health.run(ctx, conns) {
+		c.drop(peer, conn)
+		go c.health.redial(ctx, peer, c.dialer, c.restore)
+	}
+}
+
+// connections copy cache for work out of lock
+func (c *connectionStorageOnMutex[K, C]) connections() map[K]C {
+	c.cacheMx.RLock()
+	defer c.cacheMx.RUnlock()
+
+	conns := make(map[K]C, len(c.cache))
+	for ip, entry := range c.cache {
+		conns[ip] = entry.conn
+	}
+	return conns
+}
+
+// waitRoom returns nil if new connection can be stored or channel which is closed when slot may be freed
+func (c *connectionStorageOnMutex[K, C]) waitRoom() <-chan struct{} {
+	c.cacheMx.RLock()
+	defer c.cacheMx.RUnlock()
+
+	if c.capacity.hasRoom(len(c.cache)) || c.capacity.eviction != nil {
+		return nil
+	}
+	return c.slotFreed
+}
+
+// reapExpired close idle and too old connections, next GetConnection dials them again
+func (c *connectionStorageOnMutex[K, C]) reapExpired(now time.Time) {
+	c.cacheMx.Lock()
+	defer c.cacheMx.Unlock()
+
+	for ip, entry := range c.cache {
+		if entry.expired(c.expiry, now) {
+			c.evict(ip, entry)
+		}
+	}
 }
 
-func (c *connectionStorageOnMutex) closeAllConnections() {
+func (c *connectionStorageOnMutex[K, C]) closeAllConnections() {
 	c.cacheMx.Lock()
 	defer c.cacheMx.Unlock()
 
-	for ip, conn := range c.cache {
-		go func(conn domain.Connection) { conn.Close() }(conn)
-		delete(c.cache, ip)
+	for ip, entry := range c.cache {
+		c.evict(ip, entry)
 	}
 }
 
-type remoteConnChunk struct {
-	remotePeer int32
-	conn       domain.Connection
-	needUpdate bool
+type remoteConnChunk[K comparable, C domain.Connection] struct {
+	remotePeer K
+	conn       C
+	err        error
 }
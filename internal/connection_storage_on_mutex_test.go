@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"context"
 	"testing"
 
 	"github.com/goforbroke1006/unknown-livecoding-1/domain"
@@ -9,10 +10,24 @@ import (
 func TestConnectionStorageOnMutex_GetConnection(t *testing.T) {
 	const size = 1024
 
-	NewTestSuite(t, func() (storage domain.ConnectionsStorage, cancelFn func()) {
-		storage = NewConnectionStorageOnMutex(size)
+	NewTestSuite(t, func(opts ...StorageOption) (storage domain.ConnectionsStorage, cancelFn func()) {
+		storage = NewConnectionStorageOnMutex(size, opts...)
+		go storage.Run()
+		return storage, func() {
+			_ = storage.Shutdown(context.Background())
+		}
+	})
+}
 
-		return storage, func() {}
+func TestConnectionStorageOnMutex_Generic(t *testing.T) {
+	const size = 16
+
+	NewGenericTestSuite(t, func(dialer domain.Dialer[string, *resource]) (storage domain.Storage[string, *resource], cancelFn func()) {
+		storage = NewStorageOnMutex(size, dialer)
+		go storage.Run()
+		return storage, func() {
+			_ = storage.Shutdown(context.Background())
+		}
 	})
 }
 
@@ -35,9 +50,11 @@ func TestConnectionStorageOnMutex_GetConnection(t *testing.T) {
 func BenchmarkConnectionStorageOnMutex_GetConnection(b *testing.B) {
 	const size = 1024
 
-	NewBenchmarkGetConnection(b, func() (storage domain.ConnectionsStorage, cancelFn func()) {
-		storage = NewConnectionStorageOnMutex(size)
-
-		return storage, func() {}
+	NewBenchmarkGetConnection(b, func(opts ...StorageOption) (storage domain.ConnectionsStorage, cancelFn func()) {
+		storage = NewConnectionStorageOnMutex(size, opts...)
+		go storage.Run()
+		return storage, func() {
+			shutdownNoWait(storage)
+		}
 	})
 }
@@ -0,0 +1,360 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// NewConnectionStorageSharded create storage of shards partitions, initial size of cache is split between them
+func NewConnectionStorageSharded(shards, initSize int, opts ...StorageOption) *connectionStorageSharded[domain.PeerID, domain.Connection] {
+	options := newStorageOptions(opts)
+
+	return NewStorageSharded(shards, initSize, domain.PeerID.Hash, options.dialer, opts...)
+}
+
+// NewStorageSharded create storage which spreads peers by hash between shards partitions,
+// every partition has own lock, so peers of different partitions don't wait for each other.
+// Zero shards means one partition per CPU. Dial limits, circuit breaker and capacity are common for all partitions
+func NewStorageSharded[K comparable, C domain.Connection](
+	shards, initSize int, hash func(peer K) uint64, dialer domain.Dialer[K, C], opts ...StorageOption,
+) *connectionStorageSharded[K, C] {
+	if shards <= 0 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+	options := newStorageOptions(opts)
+	deps := newStorageDeps(dialer, options)
+	slots := newSlotPool(options.capacity.maxConns)
+
+	partitionOptions := options
+	partitionOptions.capacity = capacityPolicy{} // is checked by slots and sharded storage
+
+	s := &connectionStorageSharded[K, C]{
+		hash:       hash,
+		partitions: make([]*connectionStorageOnMutex[K, C], shards),
+		expiry:     options.expiry,
+		capacity:   options.capacity,
+		probe:      options.probe,
+		slots:      slots,
+		deps:       deps,
+		life:       newLifecycle(),
+	}
+	for i := range s.partitions {
+		s.partitions[i] = newStorageOnMutex(initSize/shards, partitionOptions, deps, slots)
+	}
+	s.maintenanceCtx, s.maintenanceStop = context.WithCancel(context.Background())
+
+	go func() { // storage is done when all partitions are done
+		for _, partition := range s.partitions {
+			<-partition.Done()
+		}
+		s.life.stop()
+	}()
+	return s
+}
+
+var _ domain.ConnectionsStorage = &connectionStorageSharded[domain.PeerID, domain.Connection]{}
+
+type connectionStorageSharded[K comparable, C domain.Connection] struct {
+	hash       func(peer K) uint64
+	partitions []*connectionStorageOnMutex[K, C]
+
+	expiry   expiryPolicy
+	capacity capacityPolicy
+	probe    HealthProbe
+	slots    *slotPool
+	deps     storageDeps[K, C]
+	life     *lifecycle
+
+	maintenanceCtx  context.Context // is cancelled on Shutdown, stops health checks and redials
+	maintenanceStop context.CancelFunc
+}
+
+// partition returns shard which keeps peer
+func (s *connectionStorageSharded[K, C]) partition(peer K) *connectionStorageOnMutex[K, C] {
+	return s.partitions[s.hash(peer)%uint64(len(s.partitions))]
+}
+
+// Run does background maintenance of all partitions until Shutdown
+// * reaping expired connections
+// * starting background health checks
+func (s *connectionStorageSharded[K, C]) Run() {
+	ticks := newMaintenanceTicks(s.expiry, s.deps.health.interval)
+	defer ticks.stop()
+
+	ticks.maintain(s.life.closing, func(now time.Time) {
+		for _, partition := range s.partitions {
+			partition.reapExpired(now)
+		}
+	}, func() {
+		s.checkHealth(s.maintenanceCtx, s.connections())
+	})
+
+	<-s.life.stopped // Shutdown closes connections of partitions
+}
+
+// Done is closed when all partitions are shut down and cached connections are retired
+func (s *connectionStorageSharded[K, C]) Done() <-chan struct{} {
+	return s.life.stopped
+}
+
+// Shutdown shuts partitions down concurrently and joins peers failed to close
+func (s *connectionStorageSharded[K, C]) Shutdown(ctx context.Context) error {
+	if s.life.shutdown() {
+		s.maintenanceStop()
+	}
+
+	errs := make(chan error, len(s.partitions))
+	for _, partition := range s.partitions {
+		go func(partition *connectionStorageOnMutex[K, C]) {
+			errs <- partition.Shutdown(ctx)
+		}(partition)
+	}
+
+	joined := &domain.ShutdownError{Failed: make(map[interface{}]error)}
+	for range s.partitions {
+		var shutdownErr *domain.ShutdownError
+		if err := <-errs; errors.As(err, &shutdownErr) {
+			for peer, closeErr := range shutdownErr.Failed {
+				joined.Failed[peer] = closeErr
+			}
+			if shutdownErr.Err != nil {
+				joined.Err = shutdownErr.Err
+			}
+		}
+	}
+	if len(joined.Failed) == 0 && joined.Err == nil {
+		return nil
+	}
+	return joined
+}
+
+// GetConnection returns zero C if connection can't be established
+func (s *connectionStorageSharded[K, C]) GetConnection(peer K) C {
+	conn, _ := s.GetConnectionContext(context.Background(), peer)
+	return conn
+}
+
+// GetConnectionContext makes room for peer if storage is full and gets connection from peer's partition
+func (s *connectionStorageSharded[K, C]) GetConnectionContext(ctx context.Context, peer K) (C, error) {
+	for {
+		if err := s.makeRoom(ctx, peer); err != nil {
+			var zero C
+			return zero, err
+		}
+		conn, err := s.partition(peer).GetConnectionContext(ctx, peer)
+		if s.retryFull(err) {
+			continue // slot was taken by another partition meanwhile
+		}
+		return conn, err
+	}
+}
+
+// GetConnections reads cached peers of every partition under its lock once and gets missing ones in parallel
+func (s *connectionStorageSharded[K, C]) GetConnections(ctx context.Context, peers []K) map[K]domain.ConnectionResult[C] {
+	return getBatch(ctx, peers, s.probe, s.hits, s.GetConnectionContext)
+}
+
+// hits groups peers by partition and returns their alive cached connections
+func (s *connectionStorageSharded[K, C]) hits(peers []K) map[K]C {
+	groups := make(map[*connectionStorageOnMutex[K, C]][]K)
+	for _, peer := range peers {
+		partition := s.partition(peer)
+		groups[partition] = append(groups[partition], peer)
+	}
+
+	conns := make(map[K]C, len(peers))
+	for partition, group := range groups {
+		for ip, conn := range partition.hits(group) {
+			conns[ip] = conn
+		}
+	}
+	return conns
+}
+
+// Acquire same as GetConnectionContext but borrows connection,
+// replaced or evicted connection is not closed until all its leases are released
+func (s *connectionStorageSharded[K, C]) Acquire(ctx context.Context, peer K) (domain.Lease[C], error) {
+	for {
+		if err := s.makeRoom(ctx, peer); err != nil {
+			return nil, err
+		}
+		l, err := s.partition(peer).Acquire(ctx, peer)
+		if s.retryFull(err) {
+			continue
+		}
+		return l, err
+	}
+}
+
+// OnNewRemoteConnection evicts connection of another peer if storage is full,
+// remote connection is closed if there is still no room for it
+func (s *connectionStorageSharded[K, C]) OnNewRemoteConnection(remotePeer K, conn C) {
+	partition := s.partition(remotePeer)
+	if full, _ := s.slots.full(); full && s.capacity.eviction != nil && conn.State() == domain.StateOpen {
+		if _, cached := partition.Peek(remotePeer); !cached {
+			s.evictVictim()
+		}
+	}
+	partition.OnNewRemoteConnection(remotePeer, conn)
+}
+
+// makeRoom evicts least valuable connection of any partition or waits for free slot
+// if storage is full and peer is not cached
+func (s *connectionStorageSharded[K, C]) makeRoom(ctx context.Context, peer K) error {
+	for {
+		full, freed := s.slots.full()
+		if !full {
+			return nil
+		}
+		if _, cached := s.partition(peer).Peek(peer); cached {
+			return nil
+		}
+
+		if s.capacity.eviction != nil {
+			if !s.evictVictim() {
+				return nil // nothing to evict, partition reports storage is full
+			}
+			continue
+		}
+		if s.capacity.mode != FullBlock {
+			return &domain.GetConnectionError{Peer: peer, Err: domain.ErrStorageFull}
+		}
+		select {
+		case <-freed:
+			// check again, slot can be taken by another caller already
+		case <-ctx.Done():
+			return &domain.GetConnectionError{Peer: peer, Err: ctx.Err()}
+		case <-s.life.closing:
+			return &domain.GetConnectionError{Peer: peer, Err: domain.ErrStorageClosed}
+		}
+	}
+}
+
+// retryFull reports partition could not store connection because another one took the last slot
+func (s *connectionStorageSharded[K, C]) retryFull(err error) bool {
+	return errors.Is(err, domain.ErrStorageFull) && (s.capacity.eviction != nil || s.capacity.mode == FullBlock)
+}
+
+// evictVictim picks victim of every partition under its own lock and evicts the least valuable of them,
+// returns false if eviction policy found nothing
+func (s *connectionStorageSharded[K, C]) evictVictim() bool {
+	var (
+		victimIP    K
+		victim      *cacheEntry[C]
+		victimStats EntryStats
+	)
+	for _, partition := range s.partitions {
+		partition.cacheMx.RLock()
+		ip, entry, ok := pickVictim(s.capacity.eviction, partition.cache)
+		partition.cacheMx.RUnlock()
+		if !ok {
+			continue
+		}
+		if stats := entry.stats(); victim == nil || s.capacity.eviction.Before(stats, victimStats) {
+			victimIP, victim, victimStats = ip, entry, stats
+		}
+	}
+	if victim == nil {
+		return false
+	}
+
+	partition := s.partition(victimIP)
+	partition.cacheMx.Lock()
+	partition.evict(victimIP, victim) // is skipped if victim has left cache already
+	partition.cacheMx.Unlock()
+	return true
+}
+
+// Peek returns cached open connection without dialing and without marking it used
+func (s *connectionStorageSharded[K, C]) Peek(peer K) (C, bool) {
+	return s.partition(peer).Peek(peer)
+}
+
+// Range calls fn for every cached connection until fn returns false
+func (s *connectionStorageSharded[K, C]) Range(fn func(peer K, conn C) bool) {
+	for _, partition := range s.partitions {
+		for ip, conn := range partition.connections() { // out of lock, fn may call storage
+			if !fn(ip, conn) {
+				return
+			}
+		}
+	}
+}
+
+// Len returns count of cached connections
+func (s *connectionStorageSharded[K, C]) Len() int {
+	size := 0
+	for _, partition := range s.partitions {
+		size += partition.Len()
+	}
+	return size
+}
+
+// Disconnect closes and removes peer's connection, next GetConnection dials it again
+func (s *connectionStorageSharded[K, C]) Disconnect(peer K) bool {
+	return s.partition(peer).Disconnect(peer)
+}
+
+// Stats returns counters of storage work
+func (s *connectionStorageSharded[K, C]) Stats() Stats {
+	return s.deps.counters.snapshot()
+}
+
+// Watch streams lifecycle events of cached connections matching filter until ctx is done.
+// Events are buffered by WithWatchBuffer, newer ones are dropped while buffer is full
+func (s *connectionStorageSharded[K, C]) Watch(ctx context.Context, filter WatchFilter[K]) <-chan domain.Event[K] {
+	return s.deps.events.watch(ctx, filter)
+}
+
+// Describe returns metadata of peer's cached connection
+func (s *connectionStorageSharded[K, C]) Describe(peer K) (domain.ConnectionInfo[K], bool) {
+	return s.partition(peer).Describe(peer)
+}
+
+// Snapshot returns metadata of all cached connections
+func (s *connectionStorageSharded[K, C]) Snapshot() []domain.ConnectionInfo[K] {
+	var infos []domain.ConnectionInfo[K]
+	for _, partition := range s.partitions {
+		infos = append(infos, partition.Snapshot()...)
+	}
+	return infos
+}
+
+// CircuitState returns state of circuit breaker around dials to peer
+func (s *connectionStorageSharded[K, C]) CircuitState(peer K) BreakerState {
+	return s.deps.breaker.state(peer, time.Now())
+}
+
+// HealthOf returns result of last background health check of peer
+func (s *connectionStorageSharded[K, C]) HealthOf(peer K) (ProbeResult, bool) {
+	return s.deps.health.result(peer)
+}
+
+// LeakedLeases returns leases held longer than WithLeaseLeakThreshold
+func (s *connectionStorageSharded[K, C]) LeakedLeases() []LeaseInfo[K] {
+	return s.deps.leases.leaked(time.Now())
+}
+
+// checkHealth probes connections of all partitions at once, failed ones are dropped and redialed
+func (s *connectionStorageSharded[K, C]) checkHealth(ctx context.Context, conns map[K]C) {
+	for peer, conn := range s.deps.health.run(ctx, conns) {
+		partition := s.partition(peer)
+		partition.drop(peer, conn)
+		go s.deps.health.redial(ctx, peer, s.deps.dialer, partition.restore)
+	}
+}
+
+// connections copy caches of all partitions
+func (s *connectionStorageSharded[K, C]) connections() map[K]C {
+	conns := make(map[K]C)
+	for _, partition := range s.partitions {
+		for ip, conn := range partition.connections() {
+			conns[ip] = conn
+		}
+	}
+	return conns
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"context"
+	"hash/fnv"
+	"testing"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+func TestConnectionStorageSharded_GetConnection(t *testing.T) {
+	const shards, size = 8, 1024
+
+	NewTestSuite(t, func(opts ...StorageOption) (storage domain.ConnectionsStorage, cancelFn func()) {
+		storage = NewConnectionStorageSharded(shards, size, opts...)
+		go storage.Run()
+		return storage, func() {
+			_ = storage.Shutdown(context.Background())
+		}
+	})
+}
+
+func TestConnectionStorageSharded_Generic(t *testing.T) {
+	const shards, size = 4, 16
+
+	hash := func(key string) uint64 {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(key))
+		return h.Sum64()
+	}
+	NewGenericTestSuite(t, func(dialer domain.Dialer[string, *resource]) (storage domain.Storage[string, *resource], cancelFn func()) {
+		storage = NewStorageSharded(shards, size, hash, dialer)
+		go storage.Run()
+		return storage, func() {
+			_ = storage.Shutdown(context.Background())
+		}
+	})
+}
+
+// BenchmarkConnectionStorageSharded_GetConnection checks efficiency open connection callback running
+//
+// go test -gcflags=-N -test.bench '^\QBenchmarkConnectionStorageSharded_GetConnection\E$' -run ^$ -benchmem -test.benchtime 10000x ./...
+func BenchmarkConnectionStorageSharded_GetConnection(b *testing.B) {
+	const shards, size = 8, 1024
+
+	NewBenchmarkGetConnection(b, func(opts ...StorageOption) (storage domain.ConnectionsStorage, cancelFn func()) {
+		storage = NewConnectionStorageSharded(shards, size, opts...)
+		go storage.Run()
+		return storage, func() {
+			shutdownNoWait(storage)
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"sync/atomic"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// cowIndex is immutable copy of cache which is swapped atomically on every change,
+// so readers look into it without lock. Nil index is not kept
+type cowIndex[K comparable, C domain.Connection] struct {
+	current atomic.Value // map[K]*cacheEntry[C]
+}
+
+func newCowIndex[K comparable, C domain.Connection]() *cowIndex[K, C] {
+	i := &cowIndex[K, C]{}
+	i.current.Store(map[K]*cacheEntry[C]{})
+	return i
+}
+
+// load returns current copy of cache, it must not be changed
+func (i *cowIndex[K, C]) load() map[K]*cacheEntry[C] {
+	return i.current.Load().(map[K]*cacheEntry[C])
+}
+
+// publish copies cache and swaps current copy with it.
+// Should be called under write lock of cache
+func (i *cowIndex[K, C]) publish(cache map[K]*cacheEntry[C]) {
+	if i == nil {
+		return
+	}
+	next := make(map[K]*cacheEntry[C], len(cache))
+	for ip, entry := range cache {
+		next[ip] = entry
+	}
+	i.current.Store(next)
+}
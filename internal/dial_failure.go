@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"errors"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// dialFailureTTL is how long recent dial error is returned to new callers instead of redialing
+const dialFailureTTL = 1 * time.Second
+
+// dialFailure keeps recent dial error for peer
+type dialFailure struct {
+	err error
+	at  time.Time
+}
+
+// rememberDialFailure reports err should be returned to new callers for dialFailureTTL,
+// open circuit breaker is asked again instead, so half-open trial is not delayed
+func rememberDialFailure(err error) bool {
+	return !errors.Is(err, domain.ErrCircuitOpen)
+}
+
+func (f dialFailure) fresh(now time.Time) bool {
+	return now.Sub(f.at) < dialFailureTTL
+}
+
+// dialFailures keeps recent dial errors of peers. Stale errors are swept when new one is remembered,
+// so peers which failed once and are never asked again don't grow it. Is not safe for concurrent use
+type dialFailures[K comparable] struct {
+	byPeer  map[K]dialFailure
+	sweptAt time.Time
+}
+
+func newDialFailures[K comparable]() *dialFailures[K] {
+	return &dialFailures[K]{byPeer: make(map[K]dialFailure)}
+}
+
+// remember dial error of peer, stale errors of other peers are dropped once per dialFailureTTL
+func (f *dialFailures[K]) remember(peer K, err error, now time.Time) {
+	if now.Sub(f.sweptAt) >= dialFailureTTL {
+		for p, failure := range f.byPeer {
+			if !failure.fresh(now) {
+				delete(f.byPeer, p)
+			}
+		}
+		f.sweptAt = now
+	}
+	f.byPeer[peer] = dialFailure{err: err, at: now}
+}
+
+// recent returns dial error of peer if it is fresh
+func (f *dialFailures[K]) recent(peer K, now time.Time) (error, bool) {
+	failure, failed := f.byPeer[peer]
+	if !failed || !failure.fresh(now) {
+		return nil, false
+	}
+	return failure.err, true
+}
+
+// forget error of peer, e.g. it has got connection
+func (f *dialFailures[K]) forget(peer K) {
+	delete(f.byPeer, peer)
+}
@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialFailures(t *testing.T) {
+	errDial := errors.New("connection refused")
+	now := time.Now()
+
+	failures := newDialFailures[string]()
+	failures.remember("unreachable", errDial, now)
+
+	err, failed := failures.recent("unreachable", now.Add(dialFailureTTL/2))
+	assert.True(t, failed)
+	assert.ErrorIs(t, err, errDial)
+
+	_, failed = failures.recent("unreachable", now.Add(dialFailureTTL))
+	assert.False(t, failed, "stale error is not returned")
+
+	// peer which is never asked again does not stay forever
+	failures.remember("other", errDial, now.Add(dialFailureTTL))
+	assert.Len(t, failures.byPeer, 1)
+
+	failures.forget("other")
+	assert.Empty(t, failures.byPeer)
+}
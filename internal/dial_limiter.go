@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// dialLimits bounds count of dials in flight, zero means no limit
+type dialLimits struct {
+	global  int
+	perPeer int
+}
+
+func (l dialLimits) enabled() bool {
+	return l.global > 0 || l.perPeer > 0
+}
+
+// dialLimiter lets dials go while limits allow and queues others.
+// Queue is served in arrival order, waiter which peer is at its limit is skipped
+// until peer's dial is done, so it does not hold other peers
+type dialLimiter[K comparable] struct {
+	limits   dialLimits
+	counters *counters
+
+	mx      sync.Mutex
+	active  int
+	perPeer map[K]int
+	queue   *list.List // of *dialWaiter[K]
+}
+
+type dialWaiter[K comparable] struct {
+	peer  K
+	ready chan struct{} // is closed when dial slot is given
+}
+
+func newDialLimiter[K comparable](limits dialLimits, counters *counters) *dialLimiter[K] {
+	return &dialLimiter[K]{
+		limits:   limits,
+		counters: counters,
+		perPeer:  make(map[K]int),
+		queue:    list.New(),
+	}
+}
+
+// acquire waits for dial slot of peer, returned release should be called when dial is done
+func (l *dialLimiter[K]) acquire(ctx context.Context, peer K) (release func(), err error) {
+	release = func() { l.release(peer) }
+
+	l.mx.Lock()
+	if l.fits(peer) && !l.queuedFits() { // waiters blocked by own peer's limit are not waited for
+		l.take(peer)
+		l.mx.Unlock()
+		return release, nil
+	}
+	waiter := &dialWaiter[K]{peer: peer, ready: make(chan struct{})}
+	elem := l.queue.PushBack(waiter)
+	l.mx.Unlock()
+
+	atomic.AddInt64(&l.counters.dialsQueued, 1)
+	defer atomic.AddInt64(&l.counters.dialsQueued, -1)
+
+	start := time.Now()
+	select {
+	case <-waiter.ready:
+		l.counters.dialQueued(time.Since(start))
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	l.mx.Lock()
+	select {
+	case <-waiter.ready: // slot was given meanwhile, pass it to next waiter
+		l.mx.Unlock()
+		l.release(peer)
+	default:
+		l.queue.Remove(elem)
+		l.mx.Unlock()
+	}
+	return nil, ctx.Err()
+}
+
+func (l *dialLimiter[K]) release(peer K) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.active--
+	if l.perPeer[peer]--; l.perPeer[peer] <= 0 {
+		delete(l.perPeer, peer)
+	}
+
+	for elem := l.queue.Front(); elem != nil; {
+		next := elem.Next()
+		if waiter := elem.Value.(*dialWaiter[K]); l.fits(waiter.peer) {
+			l.take(waiter.peer)
+			l.queue.Remove(elem)
+			close(waiter.ready)
+		} else if l.limits.global > 0 && l.active >= l.limits.global {
+			return
+		}
+		elem = next
+	}
+}
+
+// fits reports new dial to peer is in limits. Should be called under mx lock
+func (l *dialLimiter[K]) fits(peer K) bool {
+	if l.limits.global > 0 && l.active >= l.limits.global {
+		return false
+	}
+	return l.limits.perPeer <= 0 || l.perPeer[peer] < l.limits.perPeer
+}
+
+// queuedFits reports some queued waiter can dial now, so new caller should not overtake it.
+// Should be called under mx lock
+func (l *dialLimiter[K]) queuedFits() bool {
+	for elem := l.queue.Front(); elem != nil; elem = elem.Next() {
+		if l.fits(elem.Value.(*dialWaiter[K]).peer) {
+			return true
+		}
+	}
+	return false
+}
+
+// take dial slot. Should be called under mx lock
+func (l *dialLimiter[K]) take(peer K) {
+	l.active++
+	l.perPeer[peer]++
+}
+
+// limitedDialer wraps dialer, so it waits for limiter before dial
+func limitedDialer[K comparable, C domain.Connection](l *dialLimiter[K], dialer domain.Dialer[K, C]) domain.Dialer[K, C] {
+	if !l.limits.enabled() {
+		return dialer
+	}
+	return domain.DialerFunc[K, C](func(ctx context.Context, peer K) (C, error) {
+		release, err := l.acquire(ctx, peer)
+		if err != nil {
+			var zero C
+			return zero, err
+		}
+		defer release()
+
+		return dialer.Dial(ctx, peer)
+	})
+}
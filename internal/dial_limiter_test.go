@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialLimiter_QueueOrder(t *testing.T) {
+	l := newDialLimiter[string](dialLimits{global: 1}, &counters{})
+
+	release, err := l.acquire(context.Background(), "first")
+	assert.Nil(t, err)
+
+	order := make(chan string, 3)
+	for _, peer := range []string{"a", "b", "c"} {
+		peer := peer
+		go func() {
+			release, err := l.acquire(context.Background(), peer)
+			assert.Nil(t, err)
+			order <- peer
+			release()
+		}()
+		assert.Eventually(t, func() bool { // enqueue one by one
+			l.mx.Lock()
+			defer l.mx.Unlock()
+			return l.queue.Len() > 0 && l.queue.Back().Value.(*dialWaiter[string]).peer == peer
+		}, time.Second, time.Millisecond)
+	}
+
+	release()
+	assert.Equal(t, "a", <-order)
+	assert.Equal(t, "b", <-order)
+	assert.Equal(t, "c", <-order)
+
+	stats := l.counters.snapshot()
+	assert.Equal(t, uint64(3), stats.DialQueueWaits)
+	assert.Equal(t, int64(0), stats.DialsQueued)
+	assert.Greater(t, stats.DialQueueWaitMax, time.Duration(0))
+}
+
+func TestDialLimiter_PerPeer(t *testing.T) {
+	l := newDialLimiter[string](dialLimits{perPeer: 1}, &counters{})
+
+	release, err := l.acquire(context.Background(), "busy")
+	assert.Nil(t, err)
+
+	// other peer is not held by busy one
+	releaseOther, err := l.acquire(context.Background(), "other")
+	assert.Nil(t, err)
+	releaseOther()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx, "busy")
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 0, l.queue.Len(), "gave up waiter leaves queue")
+
+	release()
+	release, err = l.acquire(context.Background(), "busy")
+	assert.Nil(t, err)
+	release()
+	assert.Empty(t, l.perPeer)
+}
+
+func TestDialLimiter_PerPeerWaiterDoesNotHoldOthers(t *testing.T) {
+	l := newDialLimiter[string](dialLimits{global: 10, perPeer: 1}, &counters{})
+
+	release, err := l.acquire(context.Background(), "a")
+	assert.Nil(t, err)
+
+	queued := make(chan struct{})
+	go func() {
+		release, err := l.acquire(context.Background(), "a")
+		assert.Nil(t, err)
+		release()
+		close(queued)
+	}()
+	assert.Eventually(t, func() bool {
+		l.mx.Lock()
+		defer l.mx.Unlock()
+		return l.queue.Len() == 1
+	}, time.Second, time.Millisecond)
+
+	// b fits both limits, queued a waits for own peer only
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	releaseB, err := l.acquire(ctx, "b")
+	assert.Nil(t, err)
+	releaseB()
+
+	release()
+	<-queued
+	assert.Empty(t, l.perPeer)
+}
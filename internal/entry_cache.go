@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// entryCache keeps cached connections of storage and rules of changing them, which are common for storages:
+// replacing, tie-break, capacity and eviction. It is not safe for concurrent use,
+// storage guards it by own way: chan storage by Run loop, mutex storage by cacheMx lock
+type entryCache[K comparable, C domain.Connection] struct {
+	cache     map[K]*cacheEntry[C]
+	failures  *dialFailures[K]
+	slotFreed chan struct{}   // is closed and replaced when connection leaves full cache
+	slots     *slotPool       // is shared by shards of sharded storage
+	index     *cowIndex[K, C] // is lock-free copy of cache for copy-on-write storage
+
+	capacity capacityPolicy
+	tieBreak TieBreakPolicy[K]
+	events   *watchers[K]
+	life     *lifecycle
+	closer   *closeTracker[K, C]
+}
+
+func newEntryCache[K comparable, C domain.Connection](
+	initSize int, options storageOptions, deps storageDeps[K, C], slots *slotPool,
+) *entryCache[K, C] {
+	return &entryCache[K, C]{
+		cache:     make(map[K]*cacheEntry[C], initSize),
+		failures:  newDialFailures[K](),
+		slotFreed: make(chan struct{}),
+		slots:     slots,
+		capacity:  options.capacity,
+		tieBreak:  deps.tieBreak,
+		events:    deps.events,
+		life:      newLifecycle(),
+		closer:    newCloseTracker[K, C](),
+	}
+}
+
+// store put connection into cache and returns cached entry. It holds another connection
+// if tie-break policy kept it, arrived one is closed and reported by domain.EventClosed then.
+// Returns false if storage is full and nothing can be evicted or storage is shut down
+func (c *entryCache[K, C]) store(ip K, conn C, origin origin, now time.Time) (*cacheEntry[C], bool) {
+	if c.life.isClosing() { // connections are closed already or are being closed
+		return nil, false
+	}
+	entry, found := c.cache[ip]
+	if found && sameConn(entry.conn, conn) {
+		entry.touch(now)
+		return entry, true
+	}
+	if found && keepCached(c.tieBreak, ip, entry, origin.direction) {
+		c.closer.close(ip, conn)
+		c.events.emit(domain.EventClosed, ip, origin.direction, nil)
+		return entry, true
+	}
+
+	replaced := found
+	if found {
+		c.discard(ip, entry)
+	} else if !c.capacity.hasRoom(len(c.cache)) {
+		victimIP, victim, ok := pickVictim(c.capacity.eviction, c.cache)
+		if !ok {
+			return nil, false
+		}
+		c.evict(victimIP, victim)
+	}
+	if !replaced && !c.slots.take() { // shards together are full
+		return nil, false
+	}
+
+	entry = newCacheEntry(conn, origin, now)
+	c.cache[ip] = entry
+	c.index.publish(c.cache)
+	c.failures.forget(ip)
+	if replaced {
+		c.events.emit(domain.EventReplaced, ip, origin.direction, nil)
+	} else {
+		c.events.emit(domain.EventOpened, ip, origin.direction, nil)
+	}
+	return entry, true
+}
+
+// evict remove connection from cache and close it in background, entry which has left cache already is skipped
+func (c *entryCache[K, C]) evict(ip K, entry *cacheEntry[C]) {
+	if c.cache[ip] != entry {
+		return
+	}
+	c.discard(ip, entry)
+	c.slots.give()
+	c.events.emit(domain.EventClosed, ip, entry.origin.direction, nil)
+}
+
+// discard same as evict but without event and slot is kept, connection is replaced by caller
+func (c *entryCache[K, C]) discard(ip K, entry *cacheEntry[C]) {
+	delete(c.cache, ip)
+	c.index.publish(c.cache)
+	c.closer.retire(ip, entry)
+
+	if c.capacity.maxConns > 0 { // wake up callers waiting for free slot
+		close(c.slotFreed)
+		c.slotFreed = make(chan struct{})
+	}
+}
@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// errNotOpen is probe result of connection which state is not domain.StateOpen
+var errNotOpen = errors.New("connection is not open")
+
+// ProbeResult is outcome of last background health check of peer
+type ProbeResult struct {
+	At      time.Time
+	Latency time.Duration
+	Err     error
+}
+
+// Healthy reports whether probe passed
+func (r ProbeResult) Healthy() bool {
+	return r.Err == nil
+}
+
+// healthChecker probes cached connections in background and redials failed ones with reconnector
+type healthChecker[K comparable, C domain.Connection] struct {
+	interval  time.Duration
+	probe     HealthProbe
+	reconnect *reconnector[K, C]
+	checking  int32
+
+	resultsMx sync.RWMutex
+	results   map[K]ProbeResult
+	redialing map[K]struct{}
+}
+
+func newHealthChecker[K comparable, C domain.Connection](
+	interval time.Duration, probe HealthProbe, reconnect *reconnector[K, C],
+) *healthChecker[K, C] {
+	return &healthChecker[K, C]{
+		interval:  interval,
+		probe:     probe,
+		reconnect: reconnect,
+		results:   make(map[K]ProbeResult),
+		redialing: make(map[K]struct{}),
+	}
+}
+
+func (h *healthChecker[K, C]) enabled() bool {
+	return h.interval > 0
+}
+
+// run probes connections concurrently, records results and returns connections failed the probe.
+// It returns nothing if previous run is still in progress
+func (h *healthChecker[K, C]) run(ctx context.Context, conns map[K]C) map[K]C {
+	if !atomic.CompareAndSwapInt32(&h.checking, 0, 1) {
+		return nil
+	}
+	defer atomic.StoreInt32(&h.checking, 0)
+
+	ctx, cancel := context.WithTimeout(ctx, h.interval)
+	defer cancel()
+
+	var (
+		wg        sync.WaitGroup
+		resultsMx sync.Mutex
+		results   = make(map[K]ProbeResult, len(conns))
+	)
+	for peer, conn := range conns {
+		wg.Add(1)
+		go func(peer K, conn C) {
+			defer wg.Done()
+
+			result := h.check(ctx, conn)
+			resultsMx.Lock()
+			results[peer] = result
+			resultsMx.Unlock()
+		}(peer, conn)
+	}
+	wg.Wait()
+
+	failed := make(map[K]C)
+	h.resultsMx.Lock()
+	for peer := range h.results {
+		if _, checked := results[peer]; !checked {
+			if _, redialing := h.redialing[peer]; !redialing { // peer is gone
+				delete(h.results, peer)
+			}
+		}
+	}
+	for peer, result := range results {
+		h.results[peer] = result
+		if !result.Healthy() {
+			failed[peer] = conns[peer]
+		}
+	}
+	h.resultsMx.Unlock()
+
+	return failed
+}
+
+func (h *healthChecker[K, C]) check(ctx context.Context, conn C) ProbeResult {
+	start := time.Now()
+	err := h.probe.check(ctx, conn)
+	if state := conn.State(); err == nil && state != domain.StateOpen {
+		err = fmt.Errorf("%w: %s", errNotOpen, state)
+	}
+	return ProbeResult{
+		At:      start,
+		Latency: time.Since(start),
+		Err:     err,
+	}
+}
+
+func (h *healthChecker[K, C]) result(peer K) (ProbeResult, bool) {
+	h.resultsMx.RLock()
+	defer h.resultsMx.RUnlock()
+
+	result, found := h.results[peer]
+	return result, found
+}
+
+// redial dials peer with reconnector and gives connection to restore if attempts are not over.
+// restore should keep connection only if peer has no connection yet, it is closed otherwise.
+// Only one redial per peer runs at once
+func (h *healthChecker[K, C]) redial(ctx context.Context, peer K, dialer domain.Dialer[K, C], restore func(peer K, conn C, dialDuration time.Duration)) {
+	h.resultsMx.Lock()
+	if _, redialing := h.redialing[peer]; redialing {
+		h.resultsMx.Unlock()
+		return
+	}
+	h.redialing[peer] = struct{}{}
+	h.resultsMx.Unlock()
+
+	defer func() {
+		h.resultsMx.Lock()
+		delete(h.redialing, peer)
+		h.resultsMx.Unlock()
+	}()
+
+	start := time.Now()
+	conn, err := h.reconnect.dial(ctx, peer, dialer)
+	if err != nil {
+		return
+	}
+	if ctx.Err() != nil { // storage is shutting down
+		go func() { _ = conn.Close() }()
+		return
+	}
+	restore(peer, conn, time.Since(start))
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// defaultLeaseLeakThreshold is how long lease may be held before it is reported by LeakedLeases
+const defaultLeaseLeakThreshold = 1 * time.Minute
+
+// LeaseInfo describes lease held too long
+type LeaseInfo[K comparable] struct {
+	Peer     K
+	Acquired time.Time
+	Held     time.Duration
+}
+
+// lease is domain.Lease of cached connection
+type lease[K comparable, C domain.Connection] struct {
+	peer     K
+	entry    *cacheEntry[C]
+	acquired time.Time
+	released int32
+	registry *leaseRegistry[K, C]
+}
+
+var _ domain.Lease[domain.Connection] = &lease[domain.PeerID, domain.Connection]{}
+
+func (l *lease[K, C]) Conn() C {
+	return l.entry.conn
+}
+
+func (l *lease[K, C]) Release() {
+	if !atomic.CompareAndSwapInt32(&l.released, 0, 1) {
+		return
+	}
+	l.registry.forget(l)
+	l.entry.release()
+}
+
+// leaseRegistry keeps leases which are not released to find leaked ones
+type leaseRegistry[K comparable, C domain.Connection] struct {
+	leakThreshold time.Duration
+
+	activeMx sync.Mutex
+	active   map[*lease[K, C]]struct{}
+}
+
+func newLeaseRegistry[K comparable, C domain.Connection](leakThreshold time.Duration) *leaseRegistry[K, C] {
+	if leakThreshold <= 0 {
+		leakThreshold = defaultLeaseLeakThreshold
+	}
+	return &leaseRegistry[K, C]{
+		leakThreshold: leakThreshold,
+		active:        make(map[*lease[K, C]]struct{}),
+	}
+}
+
+// acquire leases entry of peer, returns false if entry is removed from cache already
+func (r *leaseRegistry[K, C]) acquire(peer K, entry *cacheEntry[C], now time.Time) (*lease[K, C], bool) {
+	if !entry.lease() {
+		return nil, false
+	}
+	l := &lease[K, C]{peer: peer, entry: entry, acquired: now, registry: r}
+
+	r.activeMx.Lock()
+	r.active[l] = struct{}{}
+	r.activeMx.Unlock()
+	return l, true
+}
+
+func (r *leaseRegistry[K, C]) forget(l *lease[K, C]) {
+	r.activeMx.Lock()
+	delete(r.active, l)
+	r.activeMx.Unlock()
+}
+
+// leaked returns leases held longer than leak threshold
+func (r *leaseRegistry[K, C]) leaked(now time.Time) []LeaseInfo[K] {
+	r.activeMx.Lock()
+	defer r.activeMx.Unlock()
+
+	var infos []LeaseInfo[K]
+	for l := range r.active {
+		if held := now.Sub(l.acquired); held >= r.leakThreshold {
+			infos = append(infos, LeaseInfo[K]{Peer: l.peer, Acquired: l.acquired, Held: held})
+		}
+	}
+	return infos
+}
@@ -0,0 +1,47 @@
+package internal
+
+import "time"
+
+// maintenanceTicks ticks background reaping and health checks, channel of disabled one is nil
+type maintenanceTicks struct {
+	reap    <-chan time.Time
+	health  <-chan time.Time
+	tickers []*time.Ticker
+}
+
+func newMaintenanceTicks(expiry expiryPolicy, healthInterval time.Duration) *maintenanceTicks {
+	t := &maintenanceTicks{}
+	if expiry.enabled() {
+		t.reap = t.start(expiry.interval())
+	}
+	if healthInterval > 0 {
+		t.health = t.start(healthInterval)
+	}
+	return t
+}
+
+func (t *maintenanceTicks) start(interval time.Duration) <-chan time.Time {
+	ticker := time.NewTicker(interval)
+	t.tickers = append(t.tickers, ticker)
+	return ticker.C
+}
+
+func (t *maintenanceTicks) stop() {
+	for _, ticker := range t.tickers {
+		ticker.Stop()
+	}
+}
+
+// maintain reaps expired connections and starts health checks on ticks until closing is closed
+func (t *maintenanceTicks) maintain(closing <-chan struct{}, reap func(now time.Time), checkHealth func()) {
+	for {
+		select {
+		case <-closing:
+			return
+		case now := <-t.reap:
+			reap(now)
+		case <-t.health:
+			go checkHealth()
+		}
+	}
+}
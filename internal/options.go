@@ -0,0 +1,214 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/aggregate"
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// StorageOption configures storages created by NewStorageOn* and NewConnectionStorageOn*
+type StorageOption func(o *storageOptions)
+
+type storageOptions struct {
+	dialer   domain.ConnectionDialer
+	expiry   expiryPolicy
+	capacity capacityPolicy
+	probe    HealthProbe
+
+	healthInterval time.Duration
+	reconnect      backoff
+	breaker        breakerPolicy
+	dialLimits     dialLimits
+	tieBreak       interface{} // TieBreakPolicy of storage's peer type
+	watchBuffer    int
+	leaseLeak      time.Duration
+}
+
+func newStorageOptions(opts []StorageOption) storageOptions {
+	o := storageOptions{
+		dialer: aggregate.NewFakeDialer(),
+		capacity: capacityPolicy{
+			eviction: EvictLRU,
+		},
+		reconnect: defaultBackoff(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// storageDeps are parts of storage built from options, shards of sharded storage share them
+type storageDeps[K comparable, C domain.Connection] struct {
+	dialer    domain.Dialer[K, C]
+	counters  *counters
+	health    *healthChecker[K, C]
+	reconnect *reconnector[K, C]
+	breaker   *circuitBreaker[K]
+	events    *watchers[K]
+	leases    *leaseRegistry[K, C]
+	tieBreak  TieBreakPolicy[K]
+}
+
+// newStorageDeps wraps dialer with limiter and circuit breaker
+func newStorageDeps[K comparable, C domain.Connection](dialer domain.Dialer[K, C], options storageOptions) storageDeps[K, C] {
+	counters := &counters{}
+	breaker := newCircuitBreaker[K](options.breaker)
+	reconnect := newReconnector[K, C](options.reconnect)
+
+	return storageDeps[K, C]{
+		dialer:    breakerDialer(breaker, limitedDialer(newDialLimiter[K](options.dialLimits, counters), dialer)),
+		counters:  counters,
+		health:    newHealthChecker(options.healthInterval, options.probe, reconnect),
+		reconnect: reconnect,
+		breaker:   breaker,
+		events:    newWatchers[K](options.watchBuffer),
+		leases:    newLeaseRegistry[K, C](options.leaseLeak),
+		tieBreak:  tieBreakFor[K](options.tieBreak),
+	}
+}
+
+// WithDialer replace default fake dialer which is used to open new connections.
+// Generic constructors NewStorageOn* take dialer as argument and ignore this option
+func WithDialer(dialer domain.ConnectionDialer) StorageOption {
+	return func(o *storageOptions) {
+		o.dialer = dialer
+	}
+}
+
+// WithIdleTimeout close and remove connection which was not requested by GetConnection for timeout
+func WithIdleTimeout(timeout time.Duration) StorageOption {
+	return func(o *storageOptions) {
+		o.expiry.idleTimeout = timeout
+	}
+}
+
+// WithMaxLifetime close and remove connection which is kept longer than lifetime even if it is used
+func WithMaxLifetime(lifetime time.Duration) StorageOption {
+	return func(o *storageOptions) {
+		o.expiry.maxLifetime = lifetime
+	}
+}
+
+// WithReapInterval set how often expired connections are looked for,
+// by default it is half of the shortest of idle timeout and max lifetime
+func WithReapInterval(interval time.Duration) StorageOption {
+	return func(o *storageOptions) {
+		o.expiry.reapInterval = interval
+	}
+}
+
+// WithMaxConnections limits count of cached connections, zero means no limit
+func WithMaxConnections(max int) StorageOption {
+	return func(o *storageOptions) {
+		o.capacity.maxConns = max
+	}
+}
+
+// WithEvictionPolicy chooses connection to close when storage is full, EvictLRU by default.
+// Nil policy disables eviction, so FullMode is applied when storage is full
+func WithEvictionPolicy(policy EvictionPolicy) StorageOption {
+	return func(o *storageOptions) {
+		o.capacity.eviction = policy
+	}
+}
+
+// WithFullMode set behaviour of GetConnection when storage is full and nothing can be evicted, FullReject by default
+func WithFullMode(mode FullMode) StorageOption {
+	return func(o *storageOptions) {
+		o.capacity.mode = mode
+	}
+}
+
+// HealthProbe checks cached connection is still alive, e.g. sends ping
+type HealthProbe func(ctx context.Context, conn domain.Connection) error
+
+// WithHealthProbe validates cached connection with probe before GetConnection returns it,
+// failed connection is dropped and dialed again. Connection.State is checked anyway
+func WithHealthProbe(probe HealthProbe) StorageOption {
+	return func(o *storageOptions) {
+		o.probe = probe
+	}
+}
+
+// WithHealthCheck probes every cached connection in background with interval,
+// connection failed HealthProbe or closed is replaced by new one dialed like WithReconnect says
+func WithHealthCheck(interval time.Duration) StorageOption {
+	return func(o *storageOptions) {
+		o.healthInterval = interval
+	}
+}
+
+// WithReconnect retries failed dial up to attempts times while maxElapsed is not over, zero maxElapsed means no limit.
+// Attempts are shared by all callers waiting for the same peer. By default dial is not retried
+func WithReconnect(attempts int, maxElapsed time.Duration) StorageOption {
+	return func(o *storageOptions) {
+		o.reconnect.attempts = attempts
+		o.reconnect.maxElapsed = maxElapsed
+	}
+}
+
+// WithReconnectBackoff set delay before first retry which doubles up to max,
+// jitter from 0 to 1 is part of delay randomly cut off, so peers are not retried all at once
+func WithReconnectBackoff(initial, max time.Duration, jitter float64) StorageOption {
+	return func(o *storageOptions) {
+		o.reconnect.initial = initial
+		o.reconnect.max = max
+		o.reconnect.jitter = jitter
+	}
+}
+
+// WithCircuitBreaker makes GetConnection fail fast with domain.ErrCircuitOpen after threshold dial failures
+// to peer in a row. Once openTimeout is passed one trial dial is let go, it closes breaker on success.
+// Zero threshold disables breaker, it is disabled by default
+func WithCircuitBreaker(threshold int, openTimeout time.Duration) StorageOption {
+	return func(o *storageOptions) {
+		o.breaker = breakerPolicy{threshold: threshold, openTimeout: openTimeout}
+	}
+}
+
+// WithDialLimits bounds count of dials in flight in whole storage and to one peer, zero means no limit.
+// Dials over limits wait in arrival order, their wait time is reported by Stats
+func WithDialLimits(global, perPeer int) StorageOption {
+	return func(o *storageOptions) {
+		o.dialLimits = dialLimits{global: global, perPeer: perPeer}
+	}
+}
+
+// WithTieBreak chooses which connection is kept when local dial and remote connection of peer race.
+// Without policy the newest connection replaces cached one. Storage of other peer type than K panics on creation
+func WithTieBreak[K comparable](policy TieBreakPolicy[K]) StorageOption {
+	return func(o *storageOptions) {
+		o.tieBreak = policy
+	}
+}
+
+// WithWatchBuffer set how many lifecycle events are kept for each watcher which does not read them yet,
+// newer events are dropped for such watcher, storage never waits for watchers
+func WithWatchBuffer(size int) StorageOption {
+	return func(o *storageOptions) {
+		o.watchBuffer = size
+	}
+}
+
+// WithLeaseLeakThreshold set how long lease may be held before LeakedLeases reports it, one minute by default
+func WithLeaseLeakThreshold(threshold time.Duration) StorageOption {
+	return func(o *storageOptions) {
+		o.leaseLeak = threshold
+	}
+}
+
+// check returns nil if probe is not set
+func (p HealthProbe) check(ctx context.Context, conn domain.Connection) error {
+	if p == nil {
+		return nil
+	}
+	return p(ctx, conn)
+}
+
+// sameConn compares connections of any type, type parameter constrained by interface is not comparable itself
+func sameConn[C domain.Connection](a, b C) bool {
+	return any(a) == any(b)
+}
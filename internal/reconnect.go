@@ -0,0 +1,131 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// reconnector retries dials to peer with backoff. Attempts of all callers dialing the same peer
+// are counted together, so flapping peer gets no more dials than policy allows.
+// Peer is forgotten when its last caller leaves, storage remembers the last dial error for new callers
+type reconnector[K comparable, C domain.Connection] struct {
+	policy backoff
+
+	peersMx sync.Mutex
+	peers   map[K]*reconnectState
+}
+
+// reconnectState is shared progress of dialing peer
+type reconnectState struct {
+	attempt int
+	started time.Time
+	retryAt time.Time
+	callers int
+}
+
+func newReconnector[K comparable, C domain.Connection](policy backoff) *reconnector[K, C] {
+	return &reconnector[K, C]{
+		policy: policy,
+		peers:  make(map[K]*reconnectState),
+	}
+}
+
+// dial opens connection to peer retrying failed dials until attempts or elapsed time are over,
+// the last dial error is returned then
+func (r *reconnector[K, C]) dial(ctx context.Context, peer K, dialer domain.Dialer[K, C]) (C, error) {
+	var zero C
+
+	state := r.join(peer, time.Now())
+	defer r.leave(peer, state)
+
+	for {
+		if wait := r.next(state, time.Now()); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return zero, ctx.Err()
+			case <-timer.C:
+			}
+		}
+
+		conn, err := dialer.Dial(ctx, peer)
+		if err == nil {
+			r.reset(peer, state)
+			return conn, nil
+		}
+		if ctx.Err() != nil { // aborted by caller, it is not peer's fault
+			return zero, err
+		}
+		if errors.Is(err, domain.ErrCircuitOpen) { // no sense to wait, breaker decides when to try again
+			r.reset(peer, state)
+			return zero, err
+		}
+		if r.failed(state, time.Now()) {
+			return zero, err
+		}
+	}
+}
+
+// join returns progress of peer shared with callers dialing it now
+func (r *reconnector[K, C]) join(peer K, now time.Time) *reconnectState {
+	r.peersMx.Lock()
+	defer r.peersMx.Unlock()
+
+	state, found := r.peers[peer]
+	if !found {
+		state = &reconnectState{started: now}
+		r.peers[peer] = state
+	}
+	state.callers++
+	return state
+}
+
+// leave forgets progress of peer if nobody dials it anymore
+func (r *reconnector[K, C]) leave(peer K, state *reconnectState) {
+	r.peersMx.Lock()
+	defer r.peersMx.Unlock()
+
+	if state.callers--; state.callers == 0 {
+		r.forget(peer, state)
+	}
+}
+
+// next returns how long to wait before dialing peer
+func (r *reconnector[K, C]) next(state *reconnectState, now time.Time) time.Duration {
+	r.peersMx.Lock()
+	defer r.peersMx.Unlock()
+
+	return state.retryAt.Sub(now)
+}
+
+// failed counts failed attempt and schedules next one, returns true if attempts are over
+func (r *reconnector[K, C]) failed(state *reconnectState, now time.Time) bool {
+	r.peersMx.Lock()
+	defer r.peersMx.Unlock()
+
+	if r.policy.exhausted(state.attempt, now.Sub(state.started)) {
+		return true
+	}
+	state.attempt++
+	state.retryAt = now.Add(r.policy.delay(state.attempt))
+	return false
+}
+
+// reset progress of peer, callers coming next start over
+func (r *reconnector[K, C]) reset(peer K, state *reconnectState) {
+	r.peersMx.Lock()
+	r.forget(peer, state)
+	r.peersMx.Unlock()
+}
+
+// forget state if it was not replaced by new one. Should be called under peersMx lock
+func (r *reconnector[K, C]) forget(peer K, state *reconnectState) {
+	if r.peers[peer] == state {
+		delete(r.peers, peer)
+	}
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+func TestBackoff_Delay(t *testing.T) {
+	b := backoff{initial: 100 * time.Millisecond, max: 1 * time.Second, jitter: 0.5}
+
+	tests := []struct {
+		attempt  int
+		min, max time.Duration
+	}{
+		{attempt: 0, min: 0, max: 0},
+		{attempt: 1, min: 50 * time.Millisecond, max: 100 * time.Millisecond},
+		{attempt: 2, min: 100 * time.Millisecond, max: 200 * time.Millisecond},
+		{attempt: 4, min: 400 * time.Millisecond, max: 800 * time.Millisecond},
+		{attempt: 10, min: 500 * time.Millisecond, max: 1 * time.Second},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			d := b.delay(tt.attempt)
+			assert.GreaterOrEqual(t, d, tt.min, "attempt %d", tt.attempt)
+			assert.LessOrEqual(t, d, tt.max, "attempt %d", tt.attempt)
+		}
+	}
+}
+
+func TestBackoff_Exhausted(t *testing.T) {
+	b := backoff{attempts: 3, maxElapsed: time.Second}
+
+	assert.False(t, b.exhausted(0, 0))
+	assert.False(t, b.exhausted(1, 500*time.Millisecond))
+	assert.True(t, b.exhausted(2, 0))
+	assert.True(t, b.exhausted(0, time.Second))
+}
+
+func TestReconnector_SharedAttempts(t *testing.T) {
+	errDial := errors.New("connection refused")
+	dials := int32(0)
+	dialer := domain.ConnectionDialerFunc(func(ctx context.Context, peer domain.PeerID) (domain.Connection, error) {
+		atomic.AddInt32(&dials, 1)
+		return nil, errDial
+	})
+
+	r := newReconnector[domain.PeerID, domain.Connection](backoff{
+		initial:  time.Millisecond,
+		max:      time.Millisecond,
+		attempts: 3,
+	})
+	peer := domain.PeerFromInt32(1)
+
+	_, err := r.dial(context.Background(), peer, dialer)
+	assert.True(t, errors.Is(err, errDial))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&dials))
+
+	_, tracked := r.peers[peer]
+	assert.False(t, tracked, "peer is forgotten when attempts are over")
+
+	// caller joined meanwhile continues attempts of flapping peer instead of starting over
+	state := r.join(peer, time.Now())
+	state.attempt = 2
+	_, err = r.dial(context.Background(), peer, dialer)
+	assert.True(t, errors.Is(err, errDial))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&dials))
+	r.leave(peer, state)
+	assert.Empty(t, r.peers)
+
+	// aborted dial is not remembered
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = r.dial(ctx, domain.PeerFromInt32(3), domain.ConnectionDialerFunc(
+		func(ctx context.Context, peer domain.PeerID) (domain.Connection, error) {
+			return nil, ctx.Err()
+		}))
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Empty(t, r.peers)
+
+	// successful dial resets progress
+	other := domain.PeerFromInt32(2)
+	conn, err := r.dial(context.Background(), other, openedDialer())
+	assert.Nil(t, err)
+	assert.NotNil(t, conn)
+	_, tracked = r.peers[other]
+	assert.False(t, tracked)
+}
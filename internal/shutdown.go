@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"context"
+	"sync"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// lifecycle tells storage goroutines storage is shutting down
+type lifecycle struct {
+	closingOnce sync.Once
+	closing     chan struct{} // is closed when Shutdown starts, new callers are rejected
+
+	stoppedOnce sync.Once
+	stopped     chan struct{} // is closed when storage stopped work and retired cached connections
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		closing: make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+}
+
+// shutdown marks storage is closing, returns false if it was marked already
+func (l *lifecycle) shutdown() bool {
+	first := false
+	l.closingOnce.Do(func() {
+		close(l.closing)
+		first = true
+	})
+	return first
+}
+
+func (l *lifecycle) isClosing() bool {
+	select {
+	case <-l.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *lifecycle) stop() {
+	l.stoppedOnce.Do(func() { close(l.stopped) })
+}
+
+// closeTracker closes connections in background and lets Shutdown wait for them
+type closeTracker[K comparable, C domain.Connection] struct {
+	mx       sync.Mutex
+	pending  map[K]int // count of connections of peer which are not closed yet
+	inFlight int
+	idle     chan struct{} // is closed when inFlight falls to zero
+	draining bool          // close errors are remembered since Shutdown started only
+	failed   map[K]error
+}
+
+func newCloseTracker[K comparable, C domain.Connection]() *closeTracker[K, C] {
+	return &closeTracker[K, C]{
+		pending: make(map[K]int),
+		failed:  make(map[K]error),
+	}
+}
+
+// close connection of peer in background
+func (t *closeTracker[K, C]) close(peer K, conn C) {
+	t.begin(peer)
+	go t.closeNow(peer, conn)
+}
+
+// retire entry of peer, its connection is closed in background once it is not leased
+func (t *closeTracker[K, C]) retire(peer K, entry *cacheEntry[C]) {
+	t.begin(peer)
+	if !entry.retire(func() { go t.closeNow(peer, entry.conn) }) {
+		t.done(peer, nil) // retired already
+	}
+}
+
+func (t *closeTracker[K, C]) closeNow(peer K, conn C) {
+	t.done(peer, conn.Close())
+}
+
+func (t *closeTracker[K, C]) begin(peer K) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if t.inFlight == 0 {
+		t.idle = make(chan struct{})
+	}
+	t.inFlight++
+	t.pending[peer]++
+}
+
+func (t *closeTracker[K, C]) done(peer K, err error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if t.pending[peer]--; t.pending[peer] == 0 {
+		delete(t.pending, peer)
+	}
+	if err != nil && t.draining {
+		t.failed[peer] = err
+	}
+	if t.inFlight--; t.inFlight == 0 {
+		close(t.idle)
+	}
+}
+
+// drain starts remembering close errors for Shutdown report
+func (t *closeTracker[K, C]) drain() {
+	t.mx.Lock()
+	t.draining = true
+	t.mx.Unlock()
+}
+
+// wait for all connections to close until ctx is done,
+// returns *domain.ShutdownError if some of them failed or are not closed yet
+func (t *closeTracker[K, C]) wait(ctx context.Context) error {
+	for {
+		t.mx.Lock()
+		idle, inFlight := t.idle, t.inFlight
+		t.mx.Unlock()
+
+		if inFlight == 0 {
+			break
+		}
+		select {
+		case <-idle:
+			continue // new close could start meanwhile
+		case <-ctx.Done():
+		}
+		break
+	}
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	shutdownErr := &domain.ShutdownError{Failed: make(map[interface{}]error, len(t.failed)+len(t.pending))}
+	for peer, err := range t.failed {
+		shutdownErr.Failed[peer] = err
+	}
+	if err := ctx.Err(); err != nil && len(t.pending) > 0 {
+		shutdownErr.Err = err
+		for peer := range t.pending {
+			shutdownErr.Failed[peer] = err
+		}
+	}
+	if len(shutdownErr.Failed) == 0 {
+		return nil
+	}
+	return shutdownErr
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Stats is counters of storage work
+type Stats struct {
+	// StaleRepaired is count of dead cached connections which were dropped by GetConnection and dialed again
+	StaleRepaired uint64
+
+	// DialsQueued is count of dials waiting for limiter now
+	DialsQueued int64
+	// DialQueueWaits is count of dials which waited for limiter
+	DialQueueWaits uint64
+	// DialQueueWaitTotal and DialQueueWaitMax are total and longest time dials spent in limiter queue
+	DialQueueWaitTotal time.Duration
+	DialQueueWaitMax   time.Duration
+}
+
+// counters are updated concurrently by storage goroutines
+type counters struct {
+	staleRepaired uint64
+
+	dialsQueued        int64
+	dialQueueWaits     uint64
+	dialQueueWaitTotal int64
+	dialQueueWaitMax   int64
+}
+
+// dialQueued counts dial left limiter queue after wait
+func (c *counters) dialQueued(wait time.Duration) {
+	atomic.AddUint64(&c.dialQueueWaits, 1)
+	atomic.AddInt64(&c.dialQueueWaitTotal, int64(wait))
+	for {
+		max := atomic.LoadInt64(&c.dialQueueWaitMax)
+		if int64(wait) <= max || atomic.CompareAndSwapInt64(&c.dialQueueWaitMax, max, int64(wait)) {
+			return
+		}
+	}
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		StaleRepaired:      atomic.LoadUint64(&c.staleRepaired),
+		DialsQueued:        atomic.LoadInt64(&c.dialsQueued),
+		DialQueueWaits:     atomic.LoadUint64(&c.dialQueueWaits),
+		DialQueueWaitTotal: time.Duration(atomic.LoadInt64(&c.dialQueueWaitTotal)),
+		DialQueueWaitMax:   time.Duration(atomic.LoadInt64(&c.dialQueueWaitMax)),
+	}
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+// TieBreakPolicy decides which connection survives when peer has open connections in both directions,
+// e.g. local dial and OnNewRemoteConnection race. DirectionUnknown means no preference, the newest is kept
+type TieBreakPolicy[K comparable] interface {
+	Prefer(peer K) domain.Direction
+}
+
+// TieBreakFunc allows to use ordinary function as TieBreakPolicy
+type TieBreakFunc[K comparable] func(peer K) domain.Direction
+
+func (f TieBreakFunc[K]) Prefer(peer K) domain.Direction {
+	return f(peer)
+}
+
+// PreferInbound keeps connection accepted from peer
+func PreferInbound[K comparable]() TieBreakPolicy[K] {
+	return TieBreakFunc[K](func(K) domain.Direction { return domain.Inbound })
+}
+
+// PreferOutbound keeps connection dialed by local side
+func PreferOutbound[K comparable]() TieBreakPolicy[K] {
+	return TieBreakFunc[K](func(K) domain.Direction { return domain.Outbound })
+}
+
+// TieBreakByPeerID keeps connection opened by side with lower peer ID, so both ends of link agree on it
+// if they use the same compare
+func TieBreakByPeerID[K comparable](local K, compare func(a, b K) int) TieBreakPolicy[K] {
+	return TieBreakFunc[K](func(remote K) domain.Direction {
+		switch c := compare(local, remote); {
+		case c < 0:
+			return domain.Outbound
+		case c > 0:
+			return domain.Inbound
+		}
+		return domain.DirectionUnknown
+	})
+}
+
+// tieBreakFor returns policy given to WithTieBreak for storage of peers K.
+// Policy made for another peer type is configuration mistake, so it panics instead of keeping the newest silently
+func tieBreakFor[K comparable](policy interface{}) TieBreakPolicy[K] {
+	if policy == nil {
+		return nil
+	}
+	typed, ok := policy.(TieBreakPolicy[K])
+	if !ok {
+		var peer K
+		panic(fmt.Sprintf("tie-break policy %T does not fit storage of %T peers", policy, peer))
+	}
+	return typed
+}
+
+// keepCached reports cached connection should survive arrived one, cached dead connection is always replaced
+func keepCached[K comparable, C domain.Connection](
+	policy TieBreakPolicy[K], peer K, cached *cacheEntry[C], arrived domain.Direction,
+) bool {
+	if policy == nil || cached.origin.direction == arrived || cached.conn.State() != domain.StateOpen {
+		return false
+	}
+	return policy.Prefer(peer) == cached.origin.direction
+}
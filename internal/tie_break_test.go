@@ -0,0 +1,28 @@
+package internal
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+func TestTieBreakByPeerID(t *testing.T) {
+	a, b := domain.PeerFromInt32(1), domain.PeerFromInt32(2)
+
+	atA := TieBreakByPeerID(a, domain.PeerID.Compare)
+	atB := TieBreakByPeerID(b, domain.PeerID.Compare)
+
+	// connection dialed by a is outbound at a and inbound at b, both ends keep it
+	assert.Equal(t, domain.Outbound, atA.Prefer(b))
+	assert.Equal(t, domain.Inbound, atB.Prefer(a))
+
+	assert.Equal(t, domain.DirectionUnknown, atA.Prefer(a))
+}
+
+func TestTieBreakFor(t *testing.T) {
+	assert.Nil(t, tieBreakFor[domain.PeerID](nil))
+	assert.NotNil(t, tieBreakFor[domain.PeerID](PreferInbound[domain.PeerID]()))
+	assert.Panics(t, func() { tieBreakFor[domain.PeerID](PreferInbound[string]()) }, "policy of other peer type")
+}
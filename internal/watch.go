@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"context"
+	"time"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+	"github.com/goforbroke1006/unknown-livecoding-1/pkg"
+)
+
+// defaultWatchBuffer is how many events are kept for watcher which does not read them yet
+const defaultWatchBuffer = 64
+
+var allEventKinds = []domain.EventKind{
+	domain.EventDialing,
+	domain.EventOpened,
+	domain.EventReplaced,
+	domain.EventClosed,
+	domain.EventDialFailed,
+}
+
+// WatchFilter selects events for watcher, empty Peers or Kinds means any
+type WatchFilter[K comparable] struct {
+	Peers []K
+	Kinds []domain.EventKind
+}
+
+func (f WatchFilter[K]) kinds() []domain.EventKind {
+	if len(f.Kinds) == 0 {
+		return allEventKinds
+	}
+	return f.Kinds
+}
+
+func (f WatchFilter[K]) match(event domain.Event[K]) bool {
+	if len(f.Peers) == 0 {
+		return true
+	}
+	for _, peer := range f.Peers {
+		if peer == event.Peer {
+			return true
+		}
+	}
+	return false
+}
+
+// watchers delivers lifecycle events to subscribers, topic is event kind.
+// Events are never waited for: watcher which buffer is full misses new events until it reads old ones
+type watchers[K comparable] struct {
+	eventsPS pkg.PubSub[domain.EventKind, domain.Event[K]]
+	buffer   int
+}
+
+func newWatchers[K comparable](buffer int) *watchers[K] {
+	if buffer <= 0 {
+		buffer = defaultWatchBuffer
+	}
+	return &watchers[K]{
+		eventsPS: pkg.NewPubSub[domain.EventKind, domain.Event[K]](),
+		buffer:   buffer,
+	}
+}
+
+// emit publishes event without blocking, it is safe under storage locks and inside Run loop
+func (w *watchers[K]) emit(kind domain.EventKind, peer K, direction domain.Direction, err error) {
+	w.eventsPS.TryPublish(kind, domain.Event[K]{
+		Kind:      kind,
+		Peer:      peer,
+		Direction: direction,
+		Err:       err,
+		At:        time.Now(),
+	})
+}
+
+// watch returns channel of events matching filter, it is closed when ctx is done
+func (w *watchers[K]) watch(ctx context.Context, filter WatchFilter[K]) <-chan domain.Event[K] {
+	in := make(chan domain.Event[K], w.buffer)
+	for _, kind := range filter.kinds() {
+		w.eventsPS.Subscribe(kind, in)
+	}
+
+	out := make(chan domain.Event[K])
+	go func() {
+		defer close(out)
+		defer func() {
+			for _, kind := range filter.kinds() {
+				w.eventsPS.Unsubscribe(kind, in)
+			}
+		}()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-in:
+				if !filter.match(event) {
+					continue
+				}
+				select {
+				case out <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
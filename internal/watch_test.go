@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/goforbroke1006/unknown-livecoding-1/domain"
+)
+
+func TestWatchers(t *testing.T) {
+	t.Run("filter by peer and kind", func(t *testing.T) {
+		w := newWatchers[string](0)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		events := w.watch(ctx, WatchFilter[string]{Peers: []string{"a"}, Kinds: []domain.EventKind{domain.EventClosed}})
+		w.emit(domain.EventOpened, "a", domain.Outbound, nil)
+		w.emit(domain.EventClosed, "b", domain.Outbound, nil)
+		w.emit(domain.EventClosed, "a", domain.Inbound, nil)
+
+		event := <-events
+		assert.Equal(t, domain.EventClosed, event.Kind)
+		assert.Equal(t, "a", event.Peer)
+		assert.Equal(t, domain.Inbound, event.Direction)
+		assert.False(t, event.At.IsZero())
+	})
+
+	t.Run("slow watcher misses newer events and does not block", func(t *testing.T) {
+		const buffer = 2
+		w := newWatchers[string](buffer)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		events := w.watch(ctx, WatchFilter[string]{})
+		for i := 0; i < 10; i++ {
+			w.emit(domain.EventDialing, "a", domain.Outbound, nil)
+		}
+
+		received := 0
+	Read:
+		for {
+			select {
+			case <-events:
+				received++
+			case <-time.After(50 * time.Millisecond):
+				break Read
+			}
+		}
+		assert.LessOrEqual(t, received, buffer+1) // one more is held by forwarding goroutine
+		assert.Greater(t, received, 0)
+	})
+
+	t.Run("channel is closed when ctx is done", func(t *testing.T) {
+		w := newWatchers[string](0)
+		ctx, cancel := context.WithCancel(context.Background())
+
+		events := w.watch(ctx, WatchFilter[string]{})
+		cancel()
+
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("channel should be closed")
+		case _, ok := <-events:
+			assert.False(t, ok)
+		}
+	})
+}
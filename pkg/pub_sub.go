@@ -2,26 +2,27 @@ package pkg
 
 import "sync"
 
-type PubSub interface {
-	Subscribe(topic string, ch chan interface{})
-	Publish(topic string, msg interface{}) bool
-	Unsubscribe(topic string, ch chan interface{})
+type PubSub[K comparable, T any] interface {
+	Subscribe(topic K, ch chan T)
+	Publish(topic K, msg T) bool
+	TryPublish(topic K, msg T) bool
+	Unsubscribe(topic K, ch chan T)
 }
 
-func NewPubSub() *pubSubPrimitive {
-	return &pubSubPrimitive{
-		subs: make(map[string][]chan interface{}),
+func NewPubSub[K comparable, T any]() *pubSubPrimitive[K, T] {
+	return &pubSubPrimitive[K, T]{
+		subs: make(map[K][]chan T),
 	}
 }
 
-type pubSubPrimitive struct {
-	subs   map[string][]chan interface{}
+type pubSubPrimitive[K comparable, T any] struct {
+	subs   map[K][]chan T
 	subsMx sync.RWMutex
 }
 
-var _ PubSub = &pubSubPrimitive{}
+var _ PubSub[string, interface{}] = &pubSubPrimitive[string, interface{}]{}
 
-func (ps *pubSubPrimitive) Subscribe(topic string, ch chan interface{}) {
+func (ps *pubSubPrimitive[K, T]) Subscribe(topic K, ch chan T) {
 	ps.subsMx.Lock()
 	defer ps.subsMx.Unlock()
 
@@ -35,7 +36,7 @@ func (ps *pubSubPrimitive) Subscribe(topic string, ch chan interface{}) {
 	ps.subs[topic] = append(ps.subs[topic], ch)
 }
 
-func (ps *pubSubPrimitive) Publish(topic string, msg interface{}) bool {
+func (ps *pubSubPrimitive[K, T]) Publish(topic K, msg T) bool {
 	ps.subsMx.RLock()
 	defer ps.subsMx.RUnlock()
 
@@ -46,7 +47,23 @@ func (ps *pubSubPrimitive) Publish(topic string, msg interface{}) bool {
 	return len(ps.subs[topic]) > 0
 }
 
-func (ps *pubSubPrimitive) Unsubscribe(topic string, ch chan interface{}) {
+// TryPublish same as Publish but skips subscribers which are not ready to receive msg
+// instead of blocking on them
+func (ps *pubSubPrimitive[K, T]) TryPublish(topic K, msg T) bool {
+	ps.subsMx.RLock()
+	defer ps.subsMx.RUnlock()
+
+	for _, ch := range ps.subs[topic] {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+
+	return len(ps.subs[topic]) > 0
+}
+
+func (ps *pubSubPrimitive[K, T]) Unsubscribe(topic K, ch chan T) {
 	ps.subsMx.Lock()
 	defer ps.subsMx.Unlock()
 
@@ -11,7 +11,7 @@ func TestPubSubPrimitive_Subscribe(t *testing.T) {
 	const topic = "hello"
 
 	t.Run("basic usage", func(t *testing.T) {
-		ps := pubSubPrimitive{
+		ps := pubSubPrimitive[string, interface{}]{
 			subs: make(map[string][]chan interface{}),
 		}
 		ch := make(chan interface{}, 2)
@@ -29,7 +29,7 @@ func TestPubSubPrimitive_Subscribe(t *testing.T) {
 	})
 
 	t.Run("prevent double subscribing on same topic", func(t *testing.T) {
-		ps := pubSubPrimitive{
+		ps := pubSubPrimitive[string, interface{}]{
 			subs: make(map[string][]chan interface{}),
 		}
 		ch := make(chan interface{}, 2)
@@ -51,11 +51,43 @@ func TestPubSubPrimitive_Subscribe(t *testing.T) {
 
 }
 
+func TestPubSubPrimitive_TryPublish(t *testing.T) {
+	const topic = "hello"
+
+	t.Run("skip subscriber with full channel", func(t *testing.T) {
+		ps := pubSubPrimitive[string, interface{}]{
+			subs: make(map[string][]chan interface{}),
+		}
+		full := make(chan interface{})
+		ch := make(chan interface{}, 2)
+		ps.Subscribe(topic, full)
+		ps.Subscribe(topic, ch)
+
+		assert.True(t, ps.TryPublish(topic, "hello"))
+		assert.True(t, ps.TryPublish(topic, "world"))
+		assert.True(t, ps.TryPublish(topic, "dropped"))
+		close(ch)
+
+		var results []interface{}
+		for msg := range ch {
+			results = append(results, msg)
+		}
+		assert.Equal(t, []interface{}{"hello", "world"}, results)
+	})
+
+	t.Run("no subscribers", func(t *testing.T) {
+		ps := pubSubPrimitive[string, interface{}]{
+			subs: make(map[string][]chan interface{}),
+		}
+		assert.False(t, ps.TryPublish(topic, "hello"))
+	})
+}
+
 func TestPubSubPrimitive_SubscribeUnsubscribe(t *testing.T) {
 	const topic = "hello"
 
 	t.Run("correct count of subscriber after pubSubPrimitive.Unsubscribe called", func(t *testing.T) {
-		ps := pubSubPrimitive{
+		ps := pubSubPrimitive[string, interface{}]{
 			subs: make(map[string][]chan interface{}),
 		}
 		assert.Equal(t, 0, len(ps.subs[topic]))
@@ -69,7 +101,7 @@ func TestPubSubPrimitive_SubscribeUnsubscribe(t *testing.T) {
 	})
 
 	t.Run("after unsubscribe can't receive messages", func(t *testing.T) {
-		ps := pubSubPrimitive{
+		ps := pubSubPrimitive[string, interface{}]{
 			subs: make(map[string][]chan interface{}),
 		}
 		ch := make(chan interface{}, 2)
@@ -98,7 +130,7 @@ func TestPubSubPrimitive_SubscribeUnsubscribe(t *testing.T) {
 //		ok      github.com/goforbroke1006/unknown-livecoding/pkg      0.005s
 func BenchmarkPubSubPrimitive_Subscribe(b *testing.B) {
 	const topic = "1234"
-	ps := pubSubPrimitive{
+	ps := pubSubPrimitive[string, interface{}]{
 		subs: make(map[string][]chan interface{}),
 	}
 	for topicIndex := 1000; topicIndex < 2000; topicIndex++ {
@@ -0,0 +1,86 @@
+package pkg
+
+import (
+	"context"
+	"sync"
+)
+
+type SingleFlight[K comparable, T any] interface {
+	Do(ctx context.Context, key K, fn func(ctx context.Context, key K) (T, error)) (v T, err error, shared bool)
+}
+
+func NewSingleFlight[K comparable, T any]() *singleFlightPrimitive[K, T] {
+	return &singleFlightPrimitive[K, T]{
+		flights: make(map[K]*flight[T]),
+	}
+}
+
+type singleFlightPrimitive[K comparable, T any] struct {
+	flights   map[K]*flight[T]
+	flightsMx sync.Mutex
+}
+
+var _ SingleFlight[string, interface{}] = &singleFlightPrimitive[string, interface{}]{}
+
+// flight is fn call shared by callers of the same key
+type flight[T any] struct {
+	done    chan struct{}
+	v       T
+	err     error
+	callers int
+	cancel  context.CancelFunc
+}
+
+// Do calls fn once for all concurrent callers of the same key and returns its result to each of them,
+// shared is true if result was given to more than one caller.
+// Caller whose ctx is done leaves with ctx.Err(), fn's ctx is cancelled only when all callers left
+func (sf *singleFlightPrimitive[K, T]) Do(
+	ctx context.Context, key K, fn func(ctx context.Context, key K) (T, error),
+) (v T, err error, shared bool) {
+	sf.flightsMx.Lock()
+	f, found := sf.flights[key]
+	if !found {
+		flightCtx, cancel := context.WithCancel(context.Background())
+		f = &flight[T]{done: make(chan struct{}), cancel: cancel}
+		sf.flights[key] = f
+
+		go func() {
+			f.v, f.err = fn(flightCtx, key)
+
+			sf.flightsMx.Lock()
+			sf.forget(key, f)
+			sf.flightsMx.Unlock()
+
+			cancel()
+			close(f.done)
+		}()
+	}
+	f.callers++
+	sf.flightsMx.Unlock()
+
+	select {
+	case <-f.done:
+		sf.flightsMx.Lock()
+		shared = f.callers > 1
+		sf.flightsMx.Unlock()
+		return f.v, f.err, shared
+
+	case <-ctx.Done():
+		sf.flightsMx.Lock()
+		if f.callers--; f.callers == 0 { // nobody waits, next caller starts new flight
+			f.cancel()
+			sf.forget(key, f)
+		}
+		sf.flightsMx.Unlock()
+
+		var zero T
+		return zero, ctx.Err(), false
+	}
+}
+
+// forget removes flight if it was not replaced by new one. Should be called under flightsMx lock
+func (sf *singleFlightPrimitive[K, T]) forget(key K, f *flight[T]) {
+	if sf.flights[key] == f {
+		delete(sf.flights, key)
+	}
+}
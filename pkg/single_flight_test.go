@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSingleFlightPrimitive_Do(t *testing.T) {
+	t.Run("concurrent callers share one call", func(t *testing.T) {
+		sf := NewSingleFlight[string, int]()
+
+		var calls int32
+		release := make(chan struct{})
+		fn := func(ctx context.Context, key string) (int, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return 42, nil
+		}
+
+		const callers = 5
+		var wg sync.WaitGroup
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				v, err, shared := sf.Do(context.Background(), "key", fn)
+				assert.Equal(t, 42, v)
+				assert.Nil(t, err)
+				assert.True(t, shared)
+			}()
+		}
+		assert.Eventually(t, func() bool {
+			sf.flightsMx.Lock()
+			defer sf.flightsMx.Unlock()
+			return sf.flights["key"] != nil && sf.flights["key"].callers == callers
+		}, time.Second, time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+		assert.Empty(t, sf.flights)
+	})
+
+	t.Run("error is given to every caller", func(t *testing.T) {
+		sf := NewSingleFlight[string, int]()
+		errCall := errors.New("call failed")
+
+		_, err, shared := sf.Do(context.Background(), "key", func(ctx context.Context, key string) (int, error) {
+			return 0, errCall
+		})
+		assert.Equal(t, errCall, err)
+		assert.False(t, shared)
+	})
+
+	t.Run("call is cancelled when all callers left", func(t *testing.T) {
+		sf := NewSingleFlight[string, int]()
+
+		cancelled := make(chan struct{})
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+
+		_, err, _ := sf.Do(ctx, "key", func(ctx context.Context, key string) (int, error) {
+			<-ctx.Done()
+			close(cancelled)
+			return 0, ctx.Err()
+		})
+		assert.Equal(t, context.DeadlineExceeded, err)
+
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("call should be cancelled")
+		case <-cancelled:
+		}
+
+		v, err, _ := sf.Do(context.Background(), "key", func(ctx context.Context, key string) (int, error) {
+			return 1, nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, v)
+	})
+}